@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Session secrets shorter than this are rejected.
+const minSessionKeyLength = 32
+
+// newSessionStore builds the cookie store from SESSION_KEYS, a comma-separated
+// list of secrets. Cookies are signed and encrypted with the first secret;
+// the others are only used to read cookies issued before a rotation, so a
+// rotation is: prepend the new secret, and drop the old one once its cookies
+// have expired.
+func newSessionStore(secureCookies bool, keys string) (*sessions.CookieStore, error) {
+	var keyPairs [][]byte
+	for _, secret := range strings.Split(keys, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		if len(secret) < minSessionKeyLength {
+			return nil, fmt.Errorf("session keys must be at least %d characters", minSessionKeyLength)
+		}
+		hashKey, blockKey := deriveSessionKeys(secret)
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+
+	if len(keyPairs) == 0 {
+		secret, err := randomHex(32)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("⚠️  SESSION_KEYS is not set, using a random key: everyone will be logged out on restart")
+		hashKey, blockKey := deriveSessionKeys(secret)
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		Secure:   secureCookies,
+		// Lax still sends the cookie on the redirect back from Spotify
+		SameSite: http.SameSiteLaxMode,
+	}
+	return store, nil
+}
+
+// deriveSessionKeys turns one secret into the HMAC key (64 bytes) and AES-256
+// key (32 bytes) the cookie store needs.
+func deriveSessionKeys(secret string) (hashKey, blockKey []byte) {
+	hashMAC := hmac.New(sha512.New, []byte(secret))
+	hashMAC.Write([]byte("spotify-voting-app session hash key"))
+
+	blockMAC := hmac.New(sha256.New, []byte(secret))
+	blockMAC.Write([]byte("spotify-voting-app session block key"))
+
+	return hashMAC.Sum(nil), blockMAC.Sum(nil)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkOAuthState compares the state Spotify sent back with the nonce stored
+// in the session at login.
+func checkOAuthState(expected, received string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(received)) == 1
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	autoDJPollInterval = 5 * time.Second
+	// Queue the next track when the current one has less than this left, so
+	// Spotify picks it up instead of continuing in playlist order.
+	autoDJQueueLead = 20 * time.Second
+	autoDJTimeout   = 30 * time.Second
+)
+
+// What happens to a track's votes after the auto-DJ played it.
+const (
+	VotePolicyReset = "reset" // clear all votes
+	VotePolicyDecay = "decay" // drop the oldest half of the votes
+)
+
+// votePolicyVoter is the user ID of vote_events recorded by a vote policy,
+// followed by the policy, e.g. "policy:reset".
+const votePolicyVoter = "policy:"
+
+// AutoDJ watches a host's playback and keeps queueing the highest-voted track
+// of a playlist that hasn't been played yet.
+type AutoDJ struct {
+	PlaylistID string    `json:"playlist_id"`
+	UserID     string    `json:"user_id"`
+	VotePolicy string    `json:"vote_policy"`
+	StartedAt  time.Time `json:"started_at"`
+
+	// Only touched by the worker goroutine
+	played  map[string]bool // track IDs played since the auto-DJ started
+	current string          // track ID currently playing
+	queued  string          // track ID we queued to play next
+	ours    string          // track ID currently playing because we queued it
+	stop    chan struct{}
+}
+
+// autoDJs is keyed by host user ID: the worker looks up the host's current
+// session on every tick, so it survives token refreshes and re-logins.
+type autoDJs struct {
+	mu      sync.Mutex
+	workers map[string]*AutoDJ
+}
+
+func (app *App) startAutoDJ(userID, playlistID, votePolicy string) *AutoDJ {
+	app.autoDJs.mu.Lock()
+	defer app.autoDJs.mu.Unlock()
+
+	if existing := app.autoDJs.workers[userID]; existing != nil {
+		close(existing.stop)
+	}
+
+	dj := &AutoDJ{
+		PlaylistID: playlistID,
+		UserID:     userID,
+		VotePolicy: votePolicy,
+		StartedAt:  time.Now(),
+		played:     make(map[string]bool),
+		stop:       make(chan struct{}),
+	}
+	app.autoDJs.workers[userID] = dj
+	go app.runAutoDJ(dj)
+
+	log.Printf("🤖 Auto-DJ started for %s on playlist %s (votes: %s)", userID, playlistID, votePolicy)
+	return dj
+}
+
+func (app *App) stopAutoDJ(userID string) bool {
+	app.autoDJs.mu.Lock()
+	defer app.autoDJs.mu.Unlock()
+
+	dj := app.autoDJs.workers[userID]
+	if dj == nil {
+		return false
+	}
+	close(dj.stop)
+	delete(app.autoDJs.workers, userID)
+
+	log.Printf("🤖 Auto-DJ stopped for %s", userID)
+	return true
+}
+
+func (app *App) getAutoDJ(userID string) *AutoDJ {
+	app.autoDJs.mu.Lock()
+	defer app.autoDJs.mu.Unlock()
+	return app.autoDJs.workers[userID]
+}
+
+func (app *App) runAutoDJ(dj *AutoDJ) {
+	ticker := time.NewTicker(autoDJPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dj.stop:
+			return
+		case <-ticker.C:
+			app.autoDJTick(dj)
+		}
+	}
+}
+
+func (app *App) autoDJTick(dj *AutoDJ) {
+	session := app.sessionForUser(dj.UserID)
+	if session == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), autoDJTimeout)
+	defer cancel()
+
+	playing, err := session.Client.PlayerCurrentlyPlaying(ctx)
+	if err != nil {
+		log.Printf("⚠️  Auto-DJ failed to get playback for %s: %v", dj.UserID, err)
+		return
+	}
+	if playing == nil || playing.Item == nil {
+		return
+	}
+
+	trackID := string(playing.Item.ID)
+	if trackID != dj.current {
+		// The track we queued has finished
+		if dj.ours != "" && dj.ours != trackID {
+			app.applyVotePolicy(trackKey{dj.PlaylistID, dj.ours}, dj.VotePolicy)
+			dj.ours = ""
+		}
+		if trackID == dj.queued {
+			dj.ours = trackID
+			dj.queued = ""
+		}
+		dj.current = trackID
+		dj.played[trackID] = true
+		app.announceNowPlaying(playing, dj.PlaylistID)
+	}
+
+	remaining := time.Duration(int(playing.Item.Duration)-int(playing.Progress)) * time.Millisecond
+	if dj.queued != "" || !playing.Playing || remaining > autoDJQueueLead {
+		return
+	}
+
+	next, err := app.nextAutoDJTrack(ctx, session, dj)
+	if err != nil {
+		log.Printf("⚠️  Auto-DJ couldn't pick a track for %s: %v", dj.UserID, err)
+		return
+	}
+
+	if err := session.Client.QueueSong(ctx, spotify.ID(next.ID)); err != nil {
+		log.Printf("⚠️  Auto-DJ failed to queue %s for %s: %v", next.ID, dj.UserID, err)
+		return
+	}
+	dj.queued = next.ID
+
+	log.Printf("🤖 Auto-DJ queued %s - %s (%d votes) for %s", next.Name, next.Artists, next.Votes, dj.UserID)
+}
+
+// nextAutoDJTrack returns the highest-voted track that hasn't been played yet.
+// Once everything has been played, it starts over.
+func (app *App) nextAutoDJTrack(ctx context.Context, session *UserSession, dj *AutoDJ) (*Track, error) {
+	tracks, err := app.playlistTracks(ctx, session.Client, dj.PlaylistID)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("playlist %s is empty", dj.PlaylistID)
+	}
+
+	totals, err := app.store.VoteTotals(dj.PlaylistID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tracks {
+		tracks[i].Votes = totals[tracks[i].ID]
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].Votes > tracks[j].Votes
+	})
+
+	for i := range tracks {
+		if !dj.played[tracks[i].ID] && tracks[i].ID != dj.current {
+			return &tracks[i], nil
+		}
+	}
+
+	// Everything has been played: start a new round
+	dj.played = map[string]bool{dj.current: true}
+	for i := range tracks {
+		if tracks[i].ID != dj.current {
+			return &tracks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no other tracks in playlist %s", dj.PlaylistID)
+}
+
+// applyVotePolicy resets or decays a track's votes once it has been played.
+func (app *App) applyVotePolicy(key trackKey, policy string) {
+	if policy != VotePolicyReset && policy != VotePolicyDecay {
+		return
+	}
+
+	total, err := app.store.ApplyVotePolicy(key, policy)
+	if err != nil {
+		log.Printf("⚠️  Failed to %s votes for track %s: %v", policy, key.TrackID, err)
+		return
+	}
+	app.publishTrackVotes(key, total)
+
+	log.Printf("🤖 Applied %s to votes of played track %s (now: %d)", policy, key.TrackID, total)
+}
+
+func (app *App) handleStartAutoDJ(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		PlaylistID string `json:"playlist_id"`
+		VotePolicy string `json:"vote_policy,omitempty"` // "reset" (default) or "decay"
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.PlaylistID == "" {
+		http.Error(w, "playlist_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.VotePolicy == "" {
+		req.VotePolicy = VotePolicyReset
+	}
+	if req.VotePolicy != VotePolicyReset && req.VotePolicy != VotePolicyDecay {
+		http.Error(w, "vote_policy must be reset or decay", http.StatusBadRequest)
+		return
+	}
+
+	dj := app.startAutoDJ(userSession.UserID, req.PlaylistID, req.VotePolicy)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": true,
+		"auto_dj": dj,
+	})
+}
+
+func (app *App) handleStopAutoDJ(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	app.stopAutoDJ(userSession.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": false})
+}
+
+func (app *App) handleGetAutoDJ(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	dj := app.getAutoDJ(userSession.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": dj != nil,
+		"auto_dj": dj,
+	})
+}
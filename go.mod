@@ -7,9 +7,12 @@ require (
 	github.com/gorilla/sessions v1.2.2
 	github.com/gorilla/websocket v1.5.1
 	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.18
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/zmb3/spotify/v2 v2.4.1
 	golang.org/x/oauth2 v0.16.0
+	golang.org/x/time v0.5.0
 )
 
 require (
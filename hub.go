@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Message types pushed to WebSocket subscribers.
+const (
+	MessageVote          = "vote"
+	MessageTrackRemoved  = "track_removed"
+	MessageTrackRestored = "track_restored"
+	MessageNowPlaying    = "now_playing"
+	MessageUserJoined    = "user_joined"
+	MessageSuggestion    = "suggestion"
+)
+
+// Message is the envelope for everything sent over /ws. Data holds one of the
+// payload types below, depending on Type.
+type Message struct {
+	Type       string      `json:"type"`
+	PlaylistID string      `json:"playlist_id"`
+	Data       interface{} `json:"data"`
+}
+
+type TrackRemoved struct {
+	TrackID   string `json:"track_id"`
+	URI       string `json:"uri"`
+	RemovedBy string `json:"removed_by"`
+}
+
+type TrackRestored struct {
+	TrackID    string `json:"track_id"`
+	URI        string `json:"uri"`
+	Position   int    `json:"position"` // -1 when appended
+	RestoredBy string `json:"restored_by"`
+}
+
+type NowPlaying struct {
+	TrackID   string `json:"track_id"`
+	Name      string `json:"name"`
+	Artists   string `json:"artists"`
+	ImageURL  string `json:"image_url"`
+	IsPlaying bool   `json:"is_playing"`
+}
+
+type UserJoined struct {
+	Nickname string `json:"nickname"`
+	RoomCode string `json:"room_code"`
+}
+
+// subscribeRequest is what clients send to pick the playlist (or room) they
+// want updates for. A connection follows one playlist at a time.
+type subscribeRequest struct {
+	Type       string `json:"type"` // "subscribe" or "unsubscribe"
+	PlaylistID string `json:"playlist_id,omitempty"`
+	Room       string `json:"room,omitempty"`
+}
+
+const (
+	clientSendBuffer = 32
+	writeTimeout     = 10 * time.Second
+)
+
+type hubClient struct {
+	conn       *websocket.Conn
+	send       chan Message
+	done       chan struct{}
+	playlistID string
+}
+
+// Hub fans messages out to the WebSocket clients subscribed to a playlist.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*hubClient]bool // playlistID -> clients
+	nowPlaying  map[string]string              // playlistID -> last announced track ID
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string]map[*hubClient]bool),
+		nowPlaying:  make(map[string]string),
+	}
+}
+
+func (h *Hub) subscribe(c *hubClient, playlistID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(c)
+	c.playlistID = playlistID
+	if playlistID == "" {
+		return
+	}
+	if h.subscribers[playlistID] == nil {
+		h.subscribers[playlistID] = make(map[*hubClient]bool)
+	}
+	h.subscribers[playlistID][c] = true
+}
+
+func (h *Hub) unsubscribe(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c)
+	c.playlistID = ""
+}
+
+func (h *Hub) removeLocked(c *hubClient) {
+	subs := h.subscribers[c.playlistID]
+	if subs == nil {
+		return
+	}
+	delete(subs, c)
+	if len(subs) == 0 {
+		delete(h.subscribers, c.playlistID)
+	}
+}
+
+// Publish sends msg to every client subscribed to msg.PlaylistID. Clients that
+// can't keep up are disconnected rather than blocking the caller.
+func (h *Hub) Publish(msg Message) {
+	h.mu.RLock()
+	clients := make([]*hubClient, 0, len(h.subscribers[msg.PlaylistID]))
+	for c := range h.subscribers[msg.PlaylistID] {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range clients {
+		select {
+		case c.send <- msg:
+		default:
+			log.Printf("⚠️  WebSocket client too slow, disconnecting")
+			c.conn.Close()
+		}
+	}
+}
+
+// PublishNowPlaying announces the track playing in a playlist's context, but
+// only when it changed since the last announcement.
+func (h *Hub) PublishNowPlaying(playlistID string, nowPlaying NowPlaying) {
+	h.mu.Lock()
+	if h.nowPlaying[playlistID] == nowPlaying.TrackID {
+		h.mu.Unlock()
+		return
+	}
+	h.nowPlaying[playlistID] = nowPlaying.TrackID
+	h.mu.Unlock()
+
+	h.Publish(Message{Type: MessageNowPlaying, PlaylistID: playlistID, Data: nowPlaying})
+}
+
+// publishVote tells everyone following the playlist about a track's new votes.
+func (app *App) publishVote(update VoteUpdate) {
+	app.hub.Publish(Message{
+		Type:       MessageVote,
+		PlaylistID: update.PlaylistID,
+		Data:       update,
+	})
+}
+
+// publishTrackVotes publishes a track's new total along with its up and down
+// votes from the store.
+func (app *App) publishTrackVotes(key trackKey, votes int) {
+	counts, err := app.store.TrackVoteCounts(key)
+	if err != nil {
+		log.Printf("⚠️  Failed to count votes for track %s: %v", key.TrackID, err)
+	}
+	app.publishVote(newVoteUpdate(key, votes, counts))
+}
+
+// announceNowPlaying publishes a now_playing message for the playlist the
+// track is being played from. playlistID overrides the playback context, e.g.
+// for a room whose host plays outside the playlist.
+func (app *App) announceNowPlaying(playing *spotify.CurrentlyPlaying, playlistID string) {
+	if playing == nil || playing.Item == nil {
+		return
+	}
+
+	if playlistID == "" {
+		contextURI := string(playing.PlaybackContext.URI)
+		if !strings.HasPrefix(contextURI, "spotify:playlist:") {
+			return
+		}
+		playlistID = strings.TrimPrefix(contextURI, "spotify:playlist:")
+	}
+
+	track := playing.Item
+	artists := make([]string, len(track.Artists))
+	for i, artist := range track.Artists {
+		artists[i] = artist.Name
+	}
+	imageURL := ""
+	if len(track.Album.Images) > 0 {
+		imageURL = track.Album.Images[0].URL
+	}
+
+	app.hub.PublishNowPlaying(playlistID, NowPlaying{
+		TrackID:   string(track.ID),
+		Name:      track.Name,
+		Artists:   strings.Join(artists, ", "),
+		ImageURL:  imageURL,
+		IsPlaying: playing.Playing,
+	})
+}
+
+func (c *hubClient) writePump() {
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				log.Printf("WebSocket error: %v", err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c := &hubClient{
+		conn: conn,
+		send: make(chan Message, clientSendBuffer),
+		done: make(chan struct{}),
+	}
+	go c.writePump()
+
+	defer func() {
+		app.hub.unsubscribe(c)
+		close(c.done)
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var req subscribeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			continue
+		}
+
+		switch req.Type {
+		case "subscribe":
+			playlistID := req.PlaylistID
+			if req.Room != "" {
+				room, err := app.getRoom(req.Room)
+				if err != nil {
+					log.Printf("⚠️  WebSocket subscribe to unknown room %s", req.Room)
+					continue
+				}
+				playlistID = room.PlaylistID
+			}
+			if voter.IsGuest() && playlistID != voter.Room.PlaylistID {
+				log.Printf("⚠️  Guest %s tried to subscribe outside their room", voter.Name)
+				continue
+			}
+			app.hub.subscribe(c, playlistID)
+		case "unsubscribe":
+			app.hub.unsubscribe(c)
+		}
+	}
+}
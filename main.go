@@ -5,12 +5,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,16 +28,13 @@ import (
 var (
 	redirectURL string
 	auth        *spotifyauth.Authenticator
-	state        = "spotify-voting-app"
-	store        = sessions.NewCookieStore([]byte("super-secret-key-change-in-production"))
-	clients      = make(map[*websocket.Conn]bool)
-	broadcast    = make(chan VoteUpdate)
+	store        *sessions.CookieStore
+	tokenKeys    *tokenKeyring
 	upgrader     = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
-	clientsMu sync.RWMutex
 )
 
 func getRedirectURL() string {
@@ -61,127 +59,148 @@ type Track struct {
 	URI      string `json:"uri"`
 	Votes    int    `json:"votes"`
 	UserVote int    `json:"user_vote"` // -1, 0, or 1
+	// The user's upvote is a superlike
+	Superliked bool `json:"superliked"`
+
+	// Votes is the net score; these break it down
+	Upvotes   int     `json:"upvotes"`
+	Downvotes int     `json:"downvotes"`
+	Net       int     `json:"net"`    // same as Votes
+	Voters    int     `json:"voters"` // users with a vote on the track
+	Score     float64 `json:"score"`  // under the ranking the tracks were sorted by
+
+	// The playlist item, see fetchPlaylistTracks
+	AddedAt  time.Time `json:"added_at"`
+	AddedBy  string    `json:"added_by"` // Spotify user ID
+	Position int       `json:"position"` // index in the playlist
 }
 
 type VoteUpdate struct {
-	TrackID string `json:"track_id"`
-	Votes   int    `json:"votes"`
+	PlaylistID string `json:"playlist_id"`
+	TrackID    string `json:"track_id"`
+	Votes      int    `json:"votes"`
+	Upvotes    int    `json:"upvotes"`
+	Downvotes  int    `json:"downvotes"`
+	Net        int    `json:"net"`
+	Voters     int    `json:"voters"`
 }
 
+// newVoteUpdate describes a track's votes for clients.
+func newVoteUpdate(key trackKey, votes int, counts VoteCounts) VoteUpdate {
+	return VoteUpdate{
+		PlaylistID: key.PlaylistID,
+		TrackID:    key.TrackID,
+		Votes:      votes,
+		Upvotes:    counts.Up,
+		Downvotes:  counts.Down,
+		Net:        votes,
+		Voters:     counts.Up + counts.Down,
+	}
+}
+
+// trackKey identifies a track within a playlist. Votes are scoped per playlist,
+// so the same song can have a different score in every playlist it appears in.
+type trackKey struct {
+	PlaylistID string
+	TrackID    string
+}
+
+// legacyPlaylistID is the playlist ID given to votes that were recorded before
+// votes were scoped per playlist. They are moved to the first playlist that
+// shows the track (see adoptLegacyVotes).
+const legacyPlaylistID = ""
+
 type UserSession struct {
 	Client       *spotify.Client
+	HTTPClient   *http.Client // authorized client for raw Web API calls
 	Token        *oauth2.Token
 	UserID       string
 	TokenSource  oauth2.TokenSource
 	LastRefresh  time.Time
+	CreatedAt    time.Time // login time, for the absolute timeout
+	LastSeen     time.Time // last request, for the idle timeout
+
+	lastSeenSaved time.Time // when LastSeen was last written to the database
+	checkedAt     time.Time // when the database row was last seen, see sessionStored
 }
 
 type App struct {
-	sessions map[string]*UserSession // sessionID -> UserSession
-	votes    map[string]int          // trackID -> vote count (in-memory cache)
-	db       *sql.DB                 // SQLite database
-	mu       sync.RWMutex
+	sessions  map[string]*UserSession // sessionID -> UserSession
+	db        *sql.DB                 // SQLite database
+	store     Store                   // votes, user votes, sessions and deleted tracks (SQLite or Postgres)
+	hub       *Hub                    // WebSocket subscribers per playlist
+	autoDJs   autoDJs                 // Auto-DJ workers per host
+	owners    playlistOwners          // Spotify owner per playlist
+	playlists playlistCache           // tracks per playlist, by snapshot
+	limiter   *rateLimiter            // rate limit buckets and throttle log
+	removals  ruleRemovals            // tracks being removed by rules
+	mu        sync.RWMutex
 }
 
-func NewApp() *App {
+func openDatabase() (*sql.DB, error) {
 	// Use persistent volume if available (Fly.io), otherwise local
 	dbPath := "./votes.db"
-	if _, err := os.Stat("/data"); err == nil {
+	if path, ok := strings.CutPrefix(os.Getenv("DATABASE_URL"), "sqlite:"); ok && path != "" {
+		dbPath = path
+		log.Printf("📁 Using database from DATABASE_URL: %s", dbPath)
+	} else if _, err := os.Stat("/data"); err == nil {
 		dbPath = "/data/votes.db"
 		log.Println("📁 Using persistent volume for database: /data/votes.db")
 	} else {
 		log.Println("📁 Using local database: ./votes.db")
 	}
 
+	return sql.Open("sqlite3", dbPath)
+}
+
+func NewApp() *App {
 	// Initialize SQLite database
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := openDatabase()
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
 
-	// Create votes table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS votes (
-			track_id TEXT PRIMARY KEY,
-			vote_count INTEGER NOT NULL DEFAULT 0,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		log.Fatal("Failed to create votes table:", err)
-	}
-
-	// Create sessions table for persistence across restarts
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS sessions (
-			session_id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			access_token TEXT NOT NULL,
-			refresh_token TEXT,
-			token_expiry TIMESTAMP NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		log.Fatal("Failed to create sessions table:", err)
-	}
-
-	// Create deleted_tracks table to track removed tracks
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS deleted_tracks (
-			track_id TEXT PRIMARY KEY,
-			playlist_id TEXT NOT NULL,
-			track_name TEXT NOT NULL,
-			track_artists TEXT NOT NULL,
-			track_album TEXT NOT NULL,
-			track_image_url TEXT,
-			track_uri TEXT NOT NULL,
-			votes_at_deletion INTEGER NOT NULL DEFAULT 0,
-			deleted_by TEXT NOT NULL,
-			deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		log.Fatal("Failed to create deleted_tracks table:", err)
-	}
-
-	// Create user_votes table to track individual user votes
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS user_votes (
-			user_id TEXT NOT NULL,
-			track_id TEXT NOT NULL,
-			vote INTEGER NOT NULL DEFAULT 0,
-			voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (user_id, track_id)
-		)
-	`)
-	if err != nil {
-		log.Fatal("Failed to create user_votes table:", err)
+	// Bring the schema up to date, see migrations.go
+	if _, err := migrateUp(db, sqliteSchema, sqliteSchema.latest()); err != nil {
+		log.Fatal("Failed to migrate database:", err)
 	}
 
-	// Create user_votes table to track individual user votes
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS user_votes (
-			user_id TEXT NOT NULL,
-			track_id TEXT NOT NULL,
-			vote INTEGER NOT NULL DEFAULT 0,
-			voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (user_id, track_id)
-		)
-	`)
+	dataStore, err := openStore(db)
 	if err != nil {
-		log.Fatal("Failed to create user_votes table:", err)
+		log.Fatal("Failed to open store:", err)
 	}
 
 	app := &App{
-		sessions: make(map[string]*UserSession),
-		votes:    make(map[string]int),
-		db:       db,
+		sessions:  make(map[string]*UserSession),
+		db:        db,
+		store:     dataStore,
+		hub:       NewHub(),
+		autoDJs:   autoDJs{workers: make(map[string]*AutoDJ)},
+		owners:    playlistOwners{owners: make(map[string]string)},
+		playlists: playlistCache{playlists: make(map[string]*cachedPlaylist)},
+		limiter:   newRateLimiter(),
+		removals:  ruleRemovals{inFlight: make(map[trackKey]bool)},
+	}
+
+	// Encrypt tokens saved before TOKEN_KEYS was set. Plaintext tokens are
+	// only refused once they are all encrypted.
+	if tokenKeys.enabled() {
+		if n, err := reencryptTokens(dataStore, tokenKeys, true); err != nil {
+			log.Printf("⚠️  Failed to encrypt stored tokens, still accepting plaintext ones: %v", err)
+		} else {
+			if n > 0 {
+				log.Printf("🔐 Encrypted stored tokens of %d sessions", n)
+			}
+			tokenKeys.rejectPlaintext = true
+		}
+	} else {
+		log.Printf("⚠️  TOKEN_KEYS is not set, Spotify tokens are stored unencrypted")
 	}
 
-	// Load existing votes from database
-	app.loadVotesFromDB()
+	// Make sure vote totals match user votes before serving them
+	checkVotesOnStartup(dataStore)
+
+	warnPerInstanceData(dataStore, db)
 
 	// Load existing sessions from database
 	app.loadSessionsFromDB()
@@ -189,149 +208,296 @@ func NewApp() *App {
 	// Start token refresh goroutine
 	go app.refreshTokensPeriodically()
 
-	// Periodic database sync (every 30 seconds)
-	go app.syncVotesToDBPeriodically()
+	// Reorder playlists on Spotify on their schedule
+	go app.runReorderSchedulesPeriodically()
+
+	// End sessions past their idle or absolute timeout
+	go app.expireSessionsPeriodically()
+
+	// Forget rate limit buckets that refilled
+	go app.dropFullRateLimitBucketsPeriodically()
 
 	return app
 }
 
-func (app *App) loadSessionsFromDB() {
-	rows, err := app.db.Query("SELECT session_id, user_id, access_token, refresh_token, token_expiry FROM sessions")
-	if err != nil {
-		log.Printf("⚠️  Failed to load sessions from database: %v", err)
-		return
+// tableExists reports whether a table with the given name exists.
+func tableExists(db sqlExecutor, table string) (bool, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false, nil
 	}
-	defer rows.Close()
+	return err == nil, err
+}
 
-	count := 0
-	expired := 0
-	for rows.Next() {
-		var sessionID, userID, accessToken string
-		var refreshToken sql.NullString
-		var tokenExpiry time.Time
+// migrateToPlaylistScopedVotes rebuilds the votes, user_votes and deleted_tracks
+// tables from the old layout (keyed by track_id only) to one keyed by
+// (playlist_id, track_id). Old votes don't know their playlist, so they are
+// stored under legacyPlaylistID until a playlist claims them.
+func migrateToPlaylistScopedVotes(tx sqlExecutor) error {
+	migrations := []struct {
+		table  string
+		create string
+		copy   string
+	}{
+		{
+			table: "votes",
+			create: `
+				CREATE TABLE votes (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote_count INTEGER NOT NULL DEFAULT 0,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (playlist_id, track_id)
+				)`,
+			copy: `
+				INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+				SELECT '', track_id, vote_count, updated_at FROM votes_legacy`,
+		},
+		{
+			table: "user_votes",
+			create: `
+				CREATE TABLE user_votes (
+					user_id TEXT NOT NULL,
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote INTEGER NOT NULL DEFAULT 0,
+					voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (user_id, playlist_id, track_id)
+				)`,
+			copy: `
+				INSERT INTO user_votes (user_id, playlist_id, track_id, vote, voted_at)
+				SELECT user_id, '', track_id, vote, voted_at FROM user_votes_legacy`,
+		},
+		{
+			table: "deleted_tracks",
+			create: `
+				CREATE TABLE deleted_tracks (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					track_name TEXT NOT NULL,
+					track_artists TEXT NOT NULL,
+					track_album TEXT NOT NULL,
+					track_image_url TEXT,
+					track_uri TEXT NOT NULL,
+					votes_at_deletion INTEGER NOT NULL DEFAULT 0,
+					deleted_by TEXT NOT NULL,
+					deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (playlist_id, track_id)
+				)`,
+			copy: `
+				INSERT INTO deleted_tracks
+				(playlist_id, track_id, track_name, track_artists, track_album, track_image_url,
+				 track_uri, votes_at_deletion, deleted_by, deleted_at)
+				SELECT playlist_id, track_id, track_name, track_artists, track_album, track_image_url,
+				       track_uri, votes_at_deletion, deleted_by, deleted_at
+				FROM deleted_tracks_legacy`,
+		},
+	}
 
-		if err := rows.Scan(&sessionID, &userID, &accessToken, &refreshToken, &tokenExpiry); err != nil {
-			log.Printf("⚠️  Error scanning session row: %v", err)
+	for _, m := range migrations {
+		exists, err := tableExists(tx, m.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
 			continue
 		}
 
-		// Skip expired sessions (expired more than 1 hour ago to allow for refresh)
-		if tokenExpiry.Before(time.Now().Add(-1 * time.Hour)) {
-			expired++
+		// deleted_tracks always had a playlist_id, so check the primary key instead
+		scoped, err := primaryKeyIncludes(tx, m.table, "playlist_id")
+		if err != nil {
+			return err
+		}
+		if scoped {
 			continue
 		}
 
-		// Recreate token and client
-		token := &oauth2.Token{
-			AccessToken: accessToken,
-			Expiry:      tokenExpiry,
-			TokenType:   "Bearer",
-		}
-		
-		if refreshToken.Valid {
-			token.RefreshToken = refreshToken.String
+		legacy := m.table + "_legacy"
+		for _, stmt := range []string{
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", m.table, legacy),
+			m.create,
+			m.copy,
+			fmt.Sprintf("DROP TABLE %s", legacy),
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("migrating %s: %w", m.table, err)
+			}
 		}
+		log.Printf("📦 Migrated %s to per-playlist votes", m.table)
+	}
 
-		// Create token source for refresh
-		ctx := context.Background()
-		tokenSource := auth.Client(ctx, token).Transport.(*oauth2.Transport).Source
+	return nil
+}
 
-		// Create Spotify client
-		httpClient := oauth2.NewClient(ctx, tokenSource)
-		client := spotify.New(httpClient)
+// primaryKeyIncludes reports whether column is part of table's primary key.
+func primaryKeyIncludes(db sqlExecutor, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
 
-		// Store in memory
-		app.sessions[sessionID] = &UserSession{
-			Client:      client,
-			Token:       token,
-			UserID:      userID,
-			TokenSource: tokenSource,
-			LastRefresh: time.Now(),
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return pk > 0, nil
 		}
-		count++
 	}
-
-	log.Printf("📊 Loaded %d sessions from database (%d expired and skipped)", count, expired)
+	return false, rows.Err()
 }
 
-func (app *App) saveSessionToDB(sessionID string, session *UserSession) error {
-	refreshToken := sql.NullString{}
-	if session.Token.RefreshToken != "" {
-		refreshToken.Valid = true
-		refreshToken.String = session.Token.RefreshToken
-	}
-
-	_, err := app.db.Exec(`
-		INSERT INTO sessions (session_id, user_id, access_token, refresh_token, token_expiry, updated_at) 
-		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(session_id) 
-		DO UPDATE SET 
-			access_token = ?,
-			refresh_token = ?,
-			token_expiry = ?,
-			updated_at = CURRENT_TIMESTAMP
-	`, sessionID, session.UserID, session.Token.AccessToken, refreshToken, session.Token.Expiry,
-		session.Token.AccessToken, refreshToken, session.Token.Expiry)
-	
+// addColumnIfMissing adds a column to an existing table, for schema changes
+// that CREATE TABLE IF NOT EXISTS won't apply to older databases.
+func addColumnIfMissing(db sqlExecutor, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
-func (app *App) loadVotesFromDB() {
-	rows, err := app.db.Query("SELECT track_id, vote_count FROM votes")
+func (app *App) loadSessionsFromDB() {
+	stored, err := app.store.LoadSessions()
 	if err != nil {
-		log.Printf("⚠️  Failed to load votes from database: %v", err)
+		log.Printf("⚠️  Failed to load sessions from database: %v", err)
 		return
 	}
-	defer rows.Close()
 
 	count := 0
-	for rows.Next() {
-		var trackID string
-		var voteCount int
-		if err := rows.Scan(&trackID, &voteCount); err != nil {
-			log.Printf("⚠️  Error scanning vote row: %v", err)
+	expired := 0
+	for _, s := range stored {
+		userSession, err := app.sessionFromStore(s)
+		if err != nil {
+			log.Printf("⚠️  Skipping session %s, can't decrypt its tokens: %v", shortSessionID(s.SessionID), err)
 			continue
 		}
-		app.votes[trackID] = voteCount
+		if userSession == nil {
+			expired++
+			continue
+		}
+
+		// Store in memory
+		app.sessions[s.SessionID] = userSession
 		count++
 	}
 
-	log.Printf("📊 Loaded %d votes from database", count)
+	log.Printf("📊 Loaded %d sessions from database (%d expired and skipped)", count, expired)
 }
 
-func (app *App) syncVotesToDB(trackID string, votes int) error {
-	_, err := app.db.Exec(`
-		INSERT INTO votes (track_id, vote_count, updated_at) 
-		VALUES (?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(track_id) 
-		DO UPDATE SET vote_count = ?, updated_at = CURRENT_TIMESTAMP
-	`, trackID, votes, votes)
-	return err
+// sessionFromStore recreates a session saved in the store, or returns nil if
+// it has expired.
+func (app *App) sessionFromStore(s StoredSession) (*UserSession, error) {
+	// Without a refresh token an expired session can't be used anymore
+	if s.RefreshToken == "" && s.TokenExpiry.Before(time.Now()) {
+		return nil, nil
+	}
+
+	// Tokens are encrypted at rest when TOKEN_KEYS is set
+	accessToken, err := tokenKeys.decrypt(s.SessionID, "access_token", s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := tokenKeys.decrypt(s.SessionID, "refresh_token", s.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recreate token and client
+	token := &oauth2.Token{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Expiry:       s.TokenExpiry,
+		TokenType:    "Bearer",
+	}
+
+	// Recreate the clients, refreshing the token when it's used
+	userSession := app.newUserSession(s.SessionID, s.UserID, token)
+	userSession.CreatedAt = s.CreatedAt
+	userSession.LastSeen = s.LastSeen
+	userSession.lastSeenSaved = s.LastSeen
+	if userSession.expired(time.Now()) {
+		return nil, nil
+	}
+	return userSession, nil
 }
 
-func (app *App) syncVotesToDBPeriodically() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+func (app *App) saveSessionToDB(sessionID string, session *UserSession) error {
+	accessToken, err := tokenKeys.encrypt(sessionID, "access_token", session.Token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := tokenKeys.encrypt(sessionID, "refresh_token", session.Token.RefreshToken)
+	if err != nil {
+		return err
+	}
 
-	for range ticker.C {
-		app.mu.RLock()
-		votesToSync := make(map[string]int)
-		for trackID, votes := range app.votes {
-			votesToSync[trackID] = votes
-		}
-		app.mu.RUnlock()
+	return app.store.SaveSession(StoredSession{
+		SessionID:    sessionID,
+		UserID:       session.UserID,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenExpiry:  session.Token.Expiry,
+		LastSeen:     session.LastSeen,
+	})
+}
 
-		// Sync all votes to database
-		for trackID, votes := range votesToSync {
-			if err := app.syncVotesToDB(trackID, votes); err != nil {
-				log.Printf("⚠️  Failed to sync votes for track %s: %v", trackID, err)
-			}
-		}
+// adoptLegacyVotes moves votes recorded before votes were scoped per playlist
+// into playlistID, for the given tracks. The first playlist that shows a track
+// claims its old votes; tracks that already have votes in playlistID are left alone.
+func (app *App) adoptLegacyVotes(playlistID string, trackIDs []string) {
+	legacy, err := app.store.VoteTotals(legacyPlaylistID)
+	if err != nil || len(legacy) == 0 {
+		return
+	}
+	scoped, err := app.store.VoteTotals(playlistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to get vote totals: %v", err)
+		return
+	}
 
-		if len(votesToSync) > 0 {
-			log.Printf("💾 Synced %d votes to database", len(votesToSync))
+	adopt := []string{}
+	for _, trackID := range trackIDs {
+		_, hasLegacy := legacy[trackID]
+		_, hasScoped := scoped[trackID]
+		if hasLegacy && !hasScoped {
+			adopt = append(adopt, trackID)
 		}
 	}
+	if len(adopt) == 0 {
+		return
+	}
+
+	if err := app.store.AdoptLegacyVotes(playlistID, adopt); err != nil {
+		log.Printf("⚠️  Failed to adopt legacy votes: %v", err)
+		return
+	}
+
+	log.Printf("📦 Moved legacy votes for %d tracks into playlist %s", len(adopt), playlistID)
 }
 
 func (app *App) refreshTokensPeriodically() {
@@ -339,33 +505,38 @@ func (app *App) refreshTokensPeriodically() {
 	defer ticker.Stop()
 	
 	for range ticker.C {
-		app.mu.Lock()
+		// The token source refreshes and saves tokens; call it outside the
+		// lock, it takes app.mu itself
+		app.mu.RLock()
+		expiring := make(map[string]*UserSession)
 		for sessionID, session := range app.sessions {
 			// Refresh if token is close to expiry (within 5 minutes)
-			if session.Token.Expiry.Before(time.Now().Add(5 * time.Minute)) {
-				log.Printf("🔄 Refreshing token for session: %s (user: %s)", sessionID, session.UserID)
-				
-				newToken, err := session.TokenSource.Token()
-				if err != nil {
-					log.Printf("❌ Failed to refresh token for %s: %v", session.UserID, err)
-					continue
-				}
-				
-				session.Token = newToken
-				session.LastRefresh = time.Now()
-				
-				// Create new client with refreshed token
-				httpClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(newToken))
-				session.Client = spotify.New(httpClient)
-				
-				log.Printf("✅ Token refreshed for %s, expires at: %s", session.UserID, newToken.Expiry)
+			if session.Token.Expiry.Before(time.Now().Add(tokenRefreshMargin)) {
+				expiring[sessionID] = session
 			}
 		}
-		app.mu.Unlock()
+		app.mu.RUnlock()
+
+		for sessionID, session := range expiring {
+			log.Printf("🔄 Refreshing token for session: %s (user: %s)", shortSessionID(sessionID), session.UserID)
+
+			newToken, err := session.TokenSource.Token()
+			if err != nil {
+				log.Printf("❌ Failed to refresh token for %s: %v", session.UserID, err)
+				continue
+			}
+
+			log.Printf("✅ Token refreshed for %s, expires at: %s", session.UserID, newToken.Expiry)
+		}
 	}
 }
 
 func (app *App) getSession(r *http.Request) (*UserSession, error) {
+	// Already looked up by a middleware
+	if voter, ok := r.Context().Value(voterContextKey{}).(*Voter); ok && !voter.IsGuest() {
+		return voter.Session, nil
+	}
+
 	session, err := store.Get(r, "spotify-session")
 	if err != nil {
 		log.Printf("Session get error: %v", err)
@@ -378,33 +549,63 @@ func (app *App) getSession(r *http.Request) (*UserSession, error) {
 		return nil, fmt.Errorf("no session ID")
 	}
 
-	log.Printf("Looking up session: %s", sessionID)
+	log.Printf("Looking up session: %s", shortSessionID(sessionID))
 
 	app.mu.RLock()
 	userSession, exists := app.sessions[sessionID]
+	expired := exists && userSession.expired(time.Now())
 	app.mu.RUnlock()
 
 	if !exists {
-		log.Printf("Session not found in memory: %s", sessionID)
+		// Another instance sharing the store may have created it
+		userSession, err = app.loadSessionFromStore(sessionID)
+		if err != nil || userSession == nil {
+			log.Printf("Session not found: %s", shortSessionID(sessionID))
+			return nil, fmt.Errorf("session not found")
+		}
+	}
+
+	if expired {
+		log.Printf("⏰ Session expired for user: %s", userSession.UserID)
+		app.endSessions([]string{sessionID})
+		return nil, fmt.Errorf("session expired")
+	}
+
+	if !app.sessionStored(sessionID, userSession) {
+		log.Printf("Session ended elsewhere: %s", shortSessionID(sessionID))
 		return nil, fmt.Errorf("session not found")
 	}
 
+	app.touchSession(sessionID, userSession)
+
 	log.Printf("Session found for user: %s", userSession.UserID)
 	return userSession, nil
 }
 
 func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "spotify-session")
-	
-	// Generate a unique session ID
-	sessionID := fmt.Sprintf("session-%d", time.Now().UnixNano())
-	session.Values["id"] = sessionID
-	session.Save(r, w)
+
+	// A fresh state nonce and PKCE verifier for every login; the callback
+	// only accepts the state stored in this browser's session
+	oauthState, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+	session.Values["oauth_state"] = oauthState
+	session.Values["oauth_verifier"] = verifier
+
+	if err := session.Save(r, w); err != nil {
+		log.Printf("⚠️  Session save error: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
 
 	// Force Spotify to show the authorization dialog AND account selection
 	// show_dialog=true: Shows the authorization screen
 	// This helps when testing with multiple accounts
-	url := auth.AuthURL(state) + "&show_dialog=true"
+	url := auth.AuthURL(oauthState, oauth2.S256ChallengeOption(verifier)) + "&show_dialog=true"
 	
 	log.Printf("🔗 Redirecting to Spotify authorization: %s", url)
 	log.Printf("💡 Tip: To test with different accounts, revoke app access at: https://www.spotify.com/account/apps/")
@@ -414,19 +615,29 @@ func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 func (app *App) handleCallback(w http.ResponseWriter, r *http.Request) {
 	log.Printf("🔄 Callback received from: %s", r.RemoteAddr)
 	
-	// Check state first
-	receivedState := r.FormValue("state")
-	log.Printf("State check - Expected: %s, Received: %s", state, receivedState)
-	
-	if receivedState != state {
-		http.NotFound(w, r)
-		log.Printf("❌ ERROR: State mismatch: %s != %s", receivedState, state)
+	// Get or create session
+	session, err := store.Get(r, "spotify-session")
+	if err != nil {
+		log.Printf("⚠️  Session get error (creating new): %v", err)
+		session, _ = store.New(r, "spotify-session")
+	}
+
+	// Check state first: it must be the nonce this browser got at login
+	expectedState, _ := session.Values["oauth_state"].(string)
+	verifier, _ := session.Values["oauth_verifier"].(string)
+	delete(session.Values, "oauth_state")
+	delete(session.Values, "oauth_verifier")
+
+	if !checkOAuthState(expectedState, r.FormValue("state")) {
+		session.Save(r, w)
+		http.Error(w, "Invalid login state, please try logging in again", http.StatusForbidden)
+		log.Printf("❌ ERROR: OAuth state mismatch from %s", r.RemoteAddr)
 		return
 	}
 
 	// Get token
 	log.Printf("Attempting to get token...")
-	token, err := auth.Token(r.Context(), state, r)
+	token, err := auth.Token(spotifyContext(r.Context()), expectedState, r, oauth2.VerifierOption(verifier))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Couldn't get token: %v", err), http.StatusForbidden)
 		log.Printf("❌ ERROR: Token error: %v", err)
@@ -438,27 +649,14 @@ func (app *App) handleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Create new client with fresh token
 	log.Printf("Creating Spotify client...")
-	httpClient := auth.Client(r.Context(), token)
-	client := spotify.New(httpClient)
-	
-	// Try to get current user with retries
-	var user *spotify.PrivateUser
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		log.Printf("Attempting to get current user (attempt %d/%d)...", i+1, maxRetries)
-		user, err = client.CurrentUser(r.Context())
-		if err == nil {
-			break
-		}
-		log.Printf("⚠️  Attempt %d failed: %v", i+1, err)
-		if i < maxRetries-1 {
-			time.Sleep(time.Second * 2)
-		}
-	}
+	client := spotify.New(auth.Client(spotifyContext(r.Context()), token))
 	
+	// Failed attempts are retried by spotifyTransport
+	log.Printf("Attempting to get current user...")
+	user, err := client.CurrentUser(r.Context())
 	if err != nil {
-		errorMsg := fmt.Sprintf("Failed to get user after %d attempts: %v", maxRetries, err)
-		http.Error(w, errorMsg, http.StatusInternalServerError)
+		errorMsg := fmt.Sprintf("Failed to get user: %v", err)
+		http.Error(w, errorMsg, spotifyErrorStatus(err))
 		log.Printf("❌ ERROR: %s", errorMsg)
 		log.Printf("Token details - Access token present: %v, Expiry: %v", token.AccessToken != "", token.Expiry)
 		return
@@ -466,18 +664,17 @@ func (app *App) handleCallback(w http.ResponseWriter, r *http.Request) {
 	
 	log.Printf("✅ User retrieved: %s (Display: %s)", user.ID, user.DisplayName)
 
-	// Get or create session
-	session, err := store.Get(r, "spotify-session")
-	if err != nil {
-		log.Printf("⚠️  Session get error (creating new): %v", err)
-		session, _ = store.New(r, "spotify-session")
+	// Always start a new session on login, so an ID set before login can't be reused
+	if oldSessionID, ok := session.Values["id"].(string); ok && oldSessionID != "" {
+		app.endSessions([]string{oldSessionID})
 	}
-	
-	sessionID, ok := session.Values["id"].(string)
-	if !ok || sessionID == "" {
-		sessionID = fmt.Sprintf("session-%d", time.Now().UnixNano())
-		log.Printf("📝 Creating new session ID: %s", sessionID)
+
+	sessionID, err := generateSessionID()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("📝 Creating new session: %s", shortSessionID(sessionID))
 	
 	session.Values["id"] = sessionID
 	err = session.Save(r, w)
@@ -485,28 +682,24 @@ func (app *App) handleCallback(w http.ResponseWriter, r *http.Request) {
 		log.Printf("⚠️  Session save error: %v", err)
 	}
 
-	// Create token source for automatic refresh
-	tokenSource := auth.Client(r.Context(), token).Transport.(*oauth2.Transport).Source
-
-	// Store user session with token source
+	// Store user session with a token source that refreshes and saves the token
+	now := time.Now()
+	userSession := app.newUserSession(sessionID, string(user.ID), token)
+	userSession.CreatedAt = now
+	userSession.LastSeen = now
+	userSession.lastSeenSaved = now
 	app.mu.Lock()
-	app.sessions[sessionID] = &UserSession{
-		Client:      client,
-		Token:       token,
-		UserID:      string(user.ID),
-		TokenSource: tokenSource,
-		LastRefresh: time.Now(),
-	}
+	app.sessions[sessionID] = userSession
 	app.mu.Unlock()
 
 	// Save session to database for persistence
-	if err := app.saveSessionToDB(sessionID, app.sessions[sessionID]); err != nil {
+	if err := app.saveSessionToDB(sessionID, userSession); err != nil {
 		log.Printf("⚠️  Failed to save session to database: %v", err)
 	} else {
 		log.Printf("💾 Session saved to database")
 	}
 
-	log.Printf("✅ User logged in successfully: %s (ID: %s) - Session: %s", user.DisplayName, user.ID, sessionID)
+	log.Printf("✅ User logged in successfully: %s (ID: %s) - Session: %s", user.DisplayName, user.ID, shortSessionID(sessionID))
 	log.Printf("🔑 Token expires at: %s", token.Expiry)
 	log.Printf("📊 Total active sessions: %d", len(app.sessions))
 	
@@ -525,7 +718,7 @@ func (app *App) handleGetPlaylists(w http.ResponseWriter, r *http.Request) {
 	playlists, err := userSession.Client.CurrentUsersPlaylists(r.Context(), spotify.Limit(50))
 	if err != nil {
 		log.Printf("ERROR: Failed to get playlists: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), spotifyErrorStatus(err))
 		return
 	}
 
@@ -534,77 +727,59 @@ func (app *App) handleGetPlaylists(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(playlists)
 }
 
-func (app *App) handleGetPlaylistTracks(w http.ResponseWriter, r *http.Request) {
-	userSession, err := app.getSession(r)
-	if err != nil {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
-		return
+// trackFromSpotify converts a Spotify track to the Track the API returns,
+// without votes.
+func trackFromSpotify(track *spotify.FullTrack) Track {
+	artists := ""
+	for i, artist := range track.Artists {
+		if i > 0 {
+			artists += ", "
+		}
+		artists += artist.Name
 	}
 
-	vars := mux.Vars(r)
-	playlistID := spotify.ID(vars["id"])
+	imageURL := ""
+	if len(track.Album.Images) > 0 {
+		imageURL = track.Album.Images[0].URL
+	}
 
+	return Track{
+		ID:       string(track.ID),
+		Name:     track.Name,
+		Artists:  artists,
+		Album:    track.Album.Name,
+		ImageURL: imageURL,
+		URI:      string(track.URI),
+	}
+}
+
+// fetchPlaylistTracks pages through all items of a playlist (100 per request)
+// and returns its tracks in playlist order, without vote information.
+func fetchPlaylistTracks(ctx context.Context, client *spotify.Client, playlistID spotify.ID) ([]Track, error) {
 	tracks := []Track{}
 	offset := 0
 	limit := 100
 
 	for {
-		playlistTracks, err := userSession.Client.GetPlaylistItems(
-			r.Context(),
+		playlistTracks, err := client.GetPlaylistItems(
+			ctx,
 			playlistID,
 			spotify.Limit(limit),
 			spotify.Offset(offset),
 		)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 
-		for _, item := range playlistTracks.Items {
+		for i, item := range playlistTracks.Items {
 			if item.Track.Track == nil {
 				continue
 			}
-			track := item.Track.Track
-
-			artists := ""
-			for i, artist := range track.Artists {
-				if i > 0 {
-					artists += ", "
-				}
-				artists += artist.Name
-			}
-
-			imageURL := ""
-			if len(track.Album.Images) > 0 {
-				imageURL = track.Album.Images[0].URL
-			}
-
-			app.mu.RLock()
-			votes := app.votes[string(track.ID)]
-			app.mu.RUnlock()
-
-			// Get user's vote for this track
-			var userVote int
-			err := app.db.QueryRow(`
-				SELECT vote FROM user_votes 
-				WHERE user_id = ? AND track_id = ?
-			`, userSession.UserID, string(track.ID)).Scan(&userVote)
-			
-			if err != nil && err != sql.ErrNoRows {
-				log.Printf("Error getting user vote: %v", err)
-			}
-			// If no row found, userVote remains 0 (not voted)
-
-			tracks = append(tracks, Track{
-				ID:       string(track.ID),
-				Name:     track.Name,
-				Artists:  artists,
-				Album:    track.Album.Name,
-				ImageURL: imageURL,
-				URI:      string(track.URI),
-				Votes:    votes,
-				UserVote: userVote,
-			})
+			track := trackFromSpotify(item.Track.Track)
+			track.AddedAt, _ = time.Parse(time.RFC3339, item.AddedAt) // missing on very old playlists
+			track.AddedBy = item.AddedBy.ID
+			track.Position = offset + i
+			tracks = append(tracks, track)
 		}
 
 		if len(playlistTracks.Items) < limit {
@@ -613,26 +788,133 @@ func (app *App) handleGetPlaylistTracks(w http.ResponseWriter, r *http.Request)
 		offset += limit
 	}
 
-	// Sort by votes (highest first)
-	sort.Slice(tracks, func(i, j int) bool {
-		return tracks[i].Votes > tracks[j].Votes
-	})
+	return tracks, nil
+}
+
+func (app *App) handleGetPlaylistTracks(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	playlistID := spotify.ID(vars["id"])
+
+	query, err := parseTrackQuery(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Guests read the playlist through the room host's session
+	userSession, err := app.sessionForPlaylist(voter, string(playlistID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tracks, err := app.playlistTracks(r.Context(), userSession.Client, string(playlistID))
+	if err != nil {
+		http.Error(w, err.Error(), spotifyErrorStatus(err))
+		return
+	}
+
+	trackIDs := make([]string, len(tracks))
+	for i, track := range tracks {
+		trackIDs[i] = track.ID
+	}
+	app.adoptLegacyVotes(string(playlistID), trackIDs)
+
+	// Totals and counts come from the store, other instances take votes too
+	totals, err := app.store.VoteTotals(string(playlistID))
+	if err != nil {
+		log.Printf("Error getting vote totals: %v", err)
+	}
+	counts, err := app.store.VoteCounts(string(playlistID))
+	if err != nil {
+		log.Printf("Error counting votes: %v", err)
+	}
+
+	// The user's votes on all tracks at once
+	userVotes, err := app.store.UserVotes(voter.UserID, string(playlistID))
+	if err != nil {
+		log.Printf("Error getting user votes: %v", err)
+	}
+
+	ranking := query.Ranking
+	var hot map[string]float64
+	if ranking == RankHot {
+		if hot, err = app.hotScores(string(playlistID), query.ScoredAt); err != nil {
+			log.Printf("Error computing hot scores: %v", err)
+		}
+	}
+
+	for i := range tracks {
+		tracks[i].Votes = totals[tracks[i].ID]
+
+		c := counts[tracks[i].ID]
+		tracks[i].Upvotes, tracks[i].Downvotes = c.Up, c.Down
+		tracks[i].Net = tracks[i].Votes
+		tracks[i].Voters = c.Up + c.Down
+		tracks[i].Score = rankScore(ranking, tracks[i].Votes, c)
+		if ranking == RankHot {
+			tracks[i].Score = hot[tracks[i].ID]
+		}
+
+		// 0 if the user didn't vote
+		userVote := userVotes[tracks[i].ID]
+		tracks[i].UserVote, tracks[i].Superliked = userVote.Vote, userVote.Superlike
+	}
+
+	page, matched, nextCursor := query.apply(tracks)
+
+	// What the user has left to vote with
+	settings, err := app.getPlaylistSettings(string(playlistID))
+	if err != nil {
+		log.Printf("Failed to get playlist settings: %v", err)
+	}
+	used, err := app.store.VoteUsage(voter.UserID, string(playlistID), settings.budgetSince(time.Now()))
+	if err != nil {
+		log.Printf("Error counting user votes: %v", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tracks)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tracks":      page,
+		"budget":      settings.budget(used),
+		"total":       len(tracks),
+		"matched":     matched,
+		"next_cursor": nextCursor,
+		"adders":      playlistAdders(tracks),
+	})
+}
+
+// toggleVote applies a click on the up (1) or down (-1) button to a user's
+// current vote and returns their new vote and the change to the total.
+func toggleVote(currentVote, vote int) (newVote int, voteDelta int) {
+	// Toggle logic (Reddit style)
+	if currentVote == vote {
+		// Clicking same button again = remove vote
+		return 0, -currentVote
+	}
+	// Clicking different button or voting for first time
+	return vote, vote - currentVote
 }
 
 func (app *App) handleVote(w http.ResponseWriter, r *http.Request) {
-	// Require authentication for voting
-	userSession, err := app.getSession(r)
+	// Require authentication for voting (Spotify login or room guest)
+	voter, err := app.getVoter(r)
 	if err != nil {
 		http.Error(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
 	var req struct {
-		TrackID string `json:"track_id"`
-		Vote    int    `json:"vote"` // 1 for upvote, -1 for downvote
+		PlaylistID string `json:"playlist_id"`
+		TrackID    string `json:"track_id"`
+		Vote       int    `json:"vote"`      // 1 for upvote, -1 for downvote
+		Superlike  bool   `json:"superlike"` // an upvote worth the playlist's superlike weight
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -645,74 +927,85 @@ func (app *App) handleVote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user's current vote for this track
-	var currentVote int
-	err = app.db.QueryRow(`
-		SELECT vote FROM user_votes 
-		WHERE user_id = ? AND track_id = ?
-	`, userSession.UserID, req.TrackID).Scan(&currentVote)
-	
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("Error getting user vote: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	if req.Superlike && req.Vote != 1 {
+		http.Error(w, "Only upvotes can be superlikes", http.StatusBadRequest)
+		return
+	}
+
+	if req.PlaylistID == "" || req.TrackID == "" {
+		http.Error(w, "playlist_id and track_id are required", http.StatusBadRequest)
 		return
 	}
 
-	var newVote int
-	var voteDelta int
+	if voter.IsGuest() && voter.Room.PlaylistID != req.PlaylistID {
+		http.Error(w, "Guests can only vote on their room's playlist", http.StatusForbidden)
+		return
+	}
 
-	// Toggle logic (Reddit style)
-	if currentVote == req.Vote {
-		// Clicking same button again = remove vote
-		newVote = 0
-		voteDelta = -currentVote // Remove the current vote
-	} else {
-		// Clicking different button or voting for first time
-		newVote = req.Vote
-		voteDelta = req.Vote - currentVote // Calculate the change
-	}
-
-	// Update user's vote in database
-	_, err = app.db.Exec(`
-		INSERT INTO user_votes (user_id, track_id, vote, voted_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(user_id, track_id) 
-		DO UPDATE SET vote = ?, voted_at = CURRENT_TIMESTAMP
-	`, userSession.UserID, req.TrackID, newVote, newVote)
-	
+	key := trackKey{PlaylistID: req.PlaylistID, TrackID: req.TrackID}
+
+	settings, err := app.getPlaylistSettings(req.PlaylistID)
 	if err != nil {
-		log.Printf("Failed to save user vote: %v", err)
-		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		log.Printf("Failed to get playlist settings: %v", err)
+		http.Error(w, "Failed to get playlist settings", http.StatusInternalServerError)
 		return
 	}
 
-	// Update total votes
-	app.mu.Lock()
-	app.votes[req.TrackID] += voteDelta
-	totalVotes := app.votes[req.TrackID]
-	app.mu.Unlock()
-
-	// Sync to database
-	if err := app.syncVotesToDB(req.TrackID, totalVotes); err != nil {
-		log.Printf("⚠️  Failed to sync vote to database: %v", err)
+	// Only hosts' votes are weighted, don't look up the role otherwise
+	role := defaultRole
+	if settings.HostVoteWeight > 1 {
+		ctx, cancel := context.WithTimeout(r.Context(), playlistOwnerTimeout)
+		role, err = app.roleFor(ctx, voter, req.PlaylistID)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get role: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
 	}
+	ballot := settings.ballot(req.Vote, req.Superlike, role, time.Now())
 
-	// Broadcast vote update to all connected clients
-	update := VoteUpdate{
-		TrackID: req.TrackID,
-		Votes:   totalVotes,
+	// The vote and the new total are committed together; the cache just
+	// mirrors what was committed
+	result, err := app.store.ApplyVote(voter.UserID, key, ballot)
+	if errors.Is(err, errNoUpvotesLeft) || errors.Is(err, errNoSuperlikesLeft) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save vote: %v", err)
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
 	}
-	broadcast <- update
+	currentVote, newVote, totalVotes := result.Previous.Vote, result.Current.Vote, result.Total
+	voteDelta := result.Delta
 
-	log.Printf("👤 User %s voted %d on track %s (was: %d, now: %d, total: %d)", 
-		userSession.UserID, req.Vote, req.TrackID, currentVote, newVote, totalVotes)
+	// Broadcast vote update to everyone following this playlist
+	update := newVoteUpdate(key, totalVotes, result.Counts)
+	app.publishVote(update)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	log.Printf("👤 User %s voted %d on track %s in playlist %s (was: %d, now: %d, worth %d, total: %d)", 
+		voter.Name, req.Vote, req.TrackID, req.PlaylistID, currentVote, newVote, result.Current.points(), totalVotes)
+
+	response := map[string]interface{}{
 		"success":   true,
 		"votes":     totalVotes,
 		"user_vote": newVote,
-	})
+		"superlike": result.Current.Superlike,
+		"budget":    settings.budget(result.Used),
+		"upvotes":   update.Upvotes,
+		"downvotes": update.Downvotes,
+		"net":       update.Net,
+		"voters":    update.Voters,
+	}
+
+	// Only a downvote can push a track over a removal threshold
+	if voteDelta < 0 {
+		go app.applyRemovalRules(key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 func (app *App) handlePlayTrack(w http.ResponseWriter, r *http.Request) {
@@ -733,13 +1026,13 @@ func (app *App) handlePlayTrack(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 
 	// First, check available devices
 	devices, err := userSession.Client.PlayerDevices(ctx)
 	if err != nil {
 		log.Printf("⚠️  Failed to get devices for %s: %v", userSession.UserID, err)
-		http.Error(w, "Failed to get Spotify devices", http.StatusInternalServerError)
+		http.Error(w, "Failed to get Spotify devices", spotifyErrorStatus(err))
 		return
 	}
 
@@ -801,7 +1094,7 @@ func (app *App) handlePlayTrack(w http.ResponseWriter, r *http.Request) {
 		transferErr := userSession.Client.TransferPlayback(ctx, *targetDeviceID, true)
 		if transferErr != nil {
 			log.Printf("❌ Failed to transfer playback for %s: %v", userSession.UserID, transferErr)
-			http.Error(w, fmt.Sprintf("Failed to play track: %v. Try playing something manually in Spotify first.", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to play track: %v. Try playing something manually in Spotify first.", err), spotifyErrorStatus(transferErr))
 			return
 		}
 
@@ -812,7 +1105,7 @@ func (app *App) handlePlayTrack(w http.ResponseWriter, r *http.Request) {
 		err = userSession.Client.PlayOpt(ctx, playOptions)
 		if err != nil {
 			log.Printf("❌ Failed to play after transfer for %s: %v", userSession.UserID, err)
-			http.Error(w, fmt.Sprintf("Failed to play track: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to play track: %v", err), spotifyErrorStatus(err))
 			return
 		}
 	}
@@ -835,11 +1128,11 @@ func (app *App) handleGetDevices(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	devices, err := userSession.Client.PlayerDevices(ctx)
 	if err != nil {
 		log.Printf("Failed to get devices: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), spotifyErrorStatus(err))
 		return
 	}
 
@@ -847,97 +1140,148 @@ func (app *App) handleGetDevices(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
-// Delete track from playlist
-func (app *App) handleDeleteTrack(w http.ResponseWriter, r *http.Request) {
-	userSession, err := app.getSession(r)
-	if err != nil {
-		http.Error(w, "Not authenticated", http.StatusUnauthorized)
-		return
-	}
-
-	var req struct {
-		PlaylistID string `json:"playlist_id"`
-		TrackURI   string `json:"track_uri"`
-		TrackID    string `json:"track_id"`
-		TrackName  string `json:"track_name"`
-		Artists    string `json:"artists"`
-		Album      string `json:"album"`
-		ImageURL   string `json:"image_url"`
-	}
+// RemovedTrack describes a track being removed from a playlist, as recorded
+// in deleted_tracks.
+type RemovedTrack struct {
+	PlaylistID string
+	TrackID    string
+	URI        string
+	Name       string
+	Artists    string
+	Album      string
+	ImageURL   string
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+// spotifyAPIError is a non-2xx response from a raw Spotify Web API call.
+type spotifyAPIError struct {
+	StatusCode int
+	Body       string
+}
 
-	ctx := context.Background()
+func (e *spotifyAPIError) Error() string {
+	return fmt.Sprintf("Spotify API error: %s", e.Body)
+}
 
+// removeTrackFromPlaylist removes the track from the playlist on Spotify using
+// userSession, records it in deleted_tracks and tells the playlist's
+// subscribers. deletedBy is a user ID or "rule:<name>" for automatic removals.
+func (app *App) removeTrackFromPlaylist(ctx context.Context, userSession *UserSession, track RemovedTrack, deletedBy string) error {
 	// Get current votes for this track
-	app.mu.RLock()
-	currentVotes := app.votes[req.TrackID]
-	app.mu.RUnlock()
-
-	// Save track info to deleted_tracks table BEFORE deleting
-	_, err = app.db.Exec(`
-		INSERT INTO deleted_tracks 
-		(track_id, playlist_id, track_name, track_artists, track_album, track_image_url, track_uri, votes_at_deletion, deleted_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(track_id) DO UPDATE SET
-			votes_at_deletion = ?,
-			deleted_at = CURRENT_TIMESTAMP
-	`, req.TrackID, req.PlaylistID, req.TrackName, req.Artists, req.Album, req.ImageURL, 
-	   req.TrackURI, currentVotes, userSession.UserID, currentVotes)
-	
+	currentVotes, err := app.store.VoteTotal(trackKey{track.PlaylistID, track.TrackID})
 	if err != nil {
-		log.Printf("⚠️  Failed to save deleted track info: %v", err)
-	} else {
-		log.Printf("💾 Saved deleted track info: %s - %s", req.TrackName, req.Artists)
+		return err
+	}
+
+	// Remember where the track was so a restore can put it back there
+	var position *int
+	if pos, err := app.trackPosition(ctx, userSession.Client, track.PlaylistID, track.URI); err != nil {
+		log.Printf("⚠️  Failed to find position of %s in playlist %s: %v", track.URI, track.PlaylistID, err)
+	} else if pos >= 0 {
+		position = &pos
 	}
 
 	// Use the Spotify Web API directly to remove tracks
-	apiURL := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s/tracks", req.PlaylistID)
+	apiURL := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s/tracks", track.PlaylistID)
 	
 	requestBody := map[string]interface{}{
 		"tracks": []map[string]string{
 			{
-				"uri": req.TrackURI,
+				"uri": track.URI,
 			},
 		},
 	}
 	
 	bodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	httpReq, err := http.NewRequestWithContext(ctx, "DELETE", apiURL, bytes.NewBuffer(bodyBytes))
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	httpReq.Header.Set("Authorization", "Bearer "+userSession.Token.AccessToken)
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	// The session's client adds a current token
+	resp, err := userSession.HTTPClient.Do(httpReq)
 	if err != nil {
-		log.Printf("❌ Failed to remove track from playlist for %s: %v", userSession.UserID, err)
-		http.Error(w, fmt.Sprintf("Failed to remove track: %v", err), http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("❌ Spotify API error: %d - %s", resp.StatusCode, string(body))
-		http.Error(w, fmt.Sprintf("Spotify API error: %s", string(body)), resp.StatusCode)
+		return &spotifyAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	// Only record the track once it's really gone, so a failed removal can
+	// be tried again and isn't offered for restore
+	if err := app.store.SaveDeletedTrack(track, currentVotes, deletedBy, position); err != nil {
+		log.Printf("⚠️  Failed to save deleted track info: %v", err)
+	} else {
+		log.Printf("💾 Saved deleted track info: %s - %s", track.Name, track.Artists)
+	}
+
+	log.Printf("🗑️  %s removed track %s from playlist %s", deletedBy, track.URI, track.PlaylistID)
+
+	app.hub.Publish(Message{
+		Type:       MessageTrackRemoved,
+		PlaylistID: track.PlaylistID,
+		Data: TrackRemoved{
+			TrackID:   track.TrackID,
+			URI:       track.URI,
+			RemovedBy: deletedBy,
+		},
+	})
+
+	return nil
+}
+
+// Delete track from playlist
+func (app *App) handleDeleteTrack(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
-	log.Printf("🗑️  User %s removed track %s from playlist %s", 
-		userSession.UserID, req.TrackURI, req.PlaylistID)
+	var req struct {
+		PlaylistID string `json:"playlist_id"`
+		TrackURI   string `json:"track_uri"`
+		TrackID    string `json:"track_id"`
+		TrackName  string `json:"track_name"`
+		Artists    string `json:"artists"`
+		Album      string `json:"album"`
+		ImageURL   string `json:"image_url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = app.removeTrackFromPlaylist(r.Context(), userSession, RemovedTrack{
+		PlaylistID: req.PlaylistID,
+		TrackID:    req.TrackID,
+		URI:        req.TrackURI,
+		Name:       req.TrackName,
+		Artists:    req.Artists,
+		Album:      req.Album,
+		ImageURL:   req.ImageURL,
+	}, userSession.UserID)
+
+	var apiErr *spotifyAPIError
+	if errors.As(err, &apiErr) {
+		log.Printf("❌ Spotify API error: %d - %s", apiErr.StatusCode, apiErr.Body)
+		http.Error(w, apiErr.Error(), apiErr.StatusCode)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to remove track from playlist for %s: %v", userSession.UserID, err)
+		http.Error(w, fmt.Sprintf("Failed to remove track: %v", err), spotifyErrorStatus(err))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
@@ -953,44 +1297,12 @@ func (app *App) handleGetDeletedTracks(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	playlistID := vars["playlistId"]
 
-	rows, err := app.db.Query(`
-		SELECT track_id, track_name, track_artists, track_album, track_image_url, 
-		       track_uri, votes_at_deletion, deleted_by, deleted_at
-		FROM deleted_tracks 
-		WHERE playlist_id = ?
-		ORDER BY deleted_at DESC
-	`, playlistID)
-	
+	deletedTracks, err := app.store.DeletedTracks(playlistID)
 	if err != nil {
 		log.Printf("Failed to get deleted tracks: %v", err)
 		http.Error(w, "Failed to get deleted tracks", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	type DeletedTrack struct {
-		ID        string `json:"id"`
-		Name      string `json:"name"`
-		Artists   string `json:"artists"`
-		Album     string `json:"album"`
-		ImageURL  string `json:"image_url"`
-		URI       string `json:"uri"`
-		Votes     int    `json:"votes"`
-		DeletedBy string `json:"deleted_by"`
-		DeletedAt string `json:"deleted_at"`
-	}
-
-	deletedTracks := []DeletedTrack{}
-	
-	for rows.Next() {
-		var track DeletedTrack
-		if err := rows.Scan(&track.ID, &track.Name, &track.Artists, &track.Album, 
-			&track.ImageURL, &track.URI, &track.Votes, &track.DeletedBy, &track.DeletedAt); err != nil {
-			log.Printf("Error scanning deleted track: %v", err)
-			continue
-		}
-		deletedTracks = append(deletedTracks, track)
-	}
 
 	log.Printf("📜 User %s fetched %d deleted tracks for playlist %s", 
 		userSession.UserID, len(deletedTracks), playlistID)
@@ -1000,20 +1312,34 @@ func (app *App) handleGetDeletedTracks(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) handleGetNowPlaying(w http.ResponseWriter, r *http.Request) {
-	userSession, err := app.getSession(r)
+	voter, err := app.getVoter(r)
 	if err != nil {
 		http.Error(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
-	ctx := context.Background()
+	// Guests see what the room host is playing
+	userSession := voter.Session
+	roomPlaylistID := ""
+	if voter.IsGuest() {
+		roomPlaylistID = voter.Room.PlaylistID
+		userSession, err = app.hostSession(voter.Room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	ctx := r.Context()
 	currentlyPlaying, err := userSession.Client.PlayerCurrentlyPlaying(ctx)
 	if err != nil {
 		log.Printf("Failed to get currently playing: %v", err)
-		http.Error(w, "Failed to get currently playing", http.StatusInternalServerError)
+		http.Error(w, "Failed to get currently playing", spotifyErrorStatus(err))
 		return
 	}
 
+	app.announceNowPlaying(currentlyPlaying, roomPlaylistID)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(currentlyPlaying)
 }
@@ -1025,13 +1351,13 @@ func (app *App) handlePlayPause(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	
 	// Get current playback state
 	currentlyPlaying, err := userSession.Client.PlayerCurrentlyPlaying(ctx)
 	if err != nil {
 		log.Printf("Failed to get playback state: %v", err)
-		http.Error(w, "Failed to get playback state", http.StatusInternalServerError)
+		http.Error(w, "Failed to get playback state", spotifyErrorStatus(err))
 		return
 	}
 
@@ -1046,7 +1372,7 @@ func (app *App) handlePlayPause(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		log.Printf("Failed to toggle play/pause: %v", err)
-		http.Error(w, "Failed to toggle play/pause", http.StatusInternalServerError)
+		http.Error(w, "Failed to toggle play/pause", spotifyErrorStatus(err))
 		return
 	}
 
@@ -1061,11 +1387,11 @@ func (app *App) handleNext(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	err = userSession.Client.Next(ctx)
 	if err != nil {
 		log.Printf("Failed to skip to next track: %v", err)
-		http.Error(w, "Failed to skip to next track", http.StatusInternalServerError)
+		http.Error(w, "Failed to skip to next track", spotifyErrorStatus(err))
 		return
 	}
 
@@ -1082,11 +1408,11 @@ func (app *App) handlePrevious(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	err = userSession.Client.Previous(ctx)
 	if err != nil {
 		log.Printf("Failed to skip to previous track: %v", err)
-		http.Error(w, "Failed to skip to previous track", http.StatusInternalServerError)
+		http.Error(w, "Failed to skip to previous track", spotifyErrorStatus(err))
 		return
 	}
 
@@ -1105,6 +1431,12 @@ func (app *App) handleGetAuthStatus(w http.ResponseWriter, r *http.Request) {
 	
 	if err == nil && userSession != nil {
 		response["user_id"] = userSession.UserID
+	} else if voter, err := app.getVoter(r); err == nil && voter.IsGuest() {
+		response["guest"] = map[string]string{
+			"nickname":    voter.Name,
+			"room_code":   voter.Room.Code,
+			"playlist_id": voter.Room.PlaylistID,
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1122,77 +1454,56 @@ func (app *App) handleLogout(w http.ResponseWriter, r *http.Request) {
 		app.mu.Unlock()
 		
 		// Delete from database
-		_, err := app.db.Exec("DELETE FROM sessions WHERE session_id = ?", sessionID)
-		if err != nil {
+		if err := app.store.DeleteSessions(sessionID); err != nil {
 			log.Printf("⚠️  Failed to delete session from database: %v", err)
 		}
 		
 		if userSession != nil {
-			log.Printf("🚪 User logged out: %s - Session: %s", userSession.UserID, sessionID)
+			log.Printf("🚪 User logged out: %s - Session: %s", userSession.UserID, shortSessionID(sessionID))
 		}
 	}
 
-	// Clear session
+	// Clear session (including any room guest identity)
 	session.Values["id"] = ""
+	delete(session.Values, "guest_id")
+	delete(session.Values, "room_code")
 	session.Options.MaxAge = -1
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+func main() {
+	// Load environment variables from .env file if present
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(".env"); err != nil {
+			log.Fatalf("Failed to load .env file: %v", err)
+		}
 	}
-	defer conn.Close()
-
-	clientsMu.Lock()
-	clients[conn] = true
-	clientsMu.Unlock()
-
-	defer func() {
-		clientsMu.Lock()
-		delete(clients, conn)
-		clientsMu.Unlock()
-	}()
 
-	// Keep connection alive
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
+	if err := loadSessionTimeouts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRateLimits(); err != nil {
+		log.Fatal(err)
 	}
-}
 
-func handleBroadcast() {
-	for {
-		update := <-broadcast
-		clientsMu.RLock()
-		for client := range clients {
-			err := client.WriteJSON(update)
-			if err != nil {
-				log.Printf("WebSocket error: %v", err)
-				client.Close()
-				clientsMu.RUnlock()
-				clientsMu.Lock()
-				delete(clients, client)
-				clientsMu.Unlock()
-				clientsMu.RLock()
-			}
-		}
-		clientsMu.RUnlock()
+	var err error
+	tokenKeys, err = newTokenKeyring(os.Getenv("TOKEN_KEYS"))
+	if err != nil {
+		log.Fatal("Invalid TOKEN_KEYS:", err)
 	}
-}
 
-func main() {
-	// Load environment variables from .env file if present
-	if _, err := os.Stat(".env"); err == nil {
-		if err := godotenv.Load(".env"); err != nil {
-			log.Fatalf("Failed to load .env file: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-token-keys":
+			runRotateTokenKeys()
+		case "migrate":
+			runMigrate(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q (available: rotate-token-keys, migrate)", os.Args[1])
 		}
+		return
 	}
 
 	clientID := os.Getenv("SPOTIFY_ID")
@@ -1204,6 +1515,11 @@ func main() {
 
 	// Initialize redirect URL and auth AFTER env vars are set
 	redirectURL = getRedirectURL()
+
+	store, err = newSessionStore(strings.HasPrefix(redirectURL, "https://"), os.Getenv("SESSION_KEYS"))
+	if err != nil {
+		log.Fatal("Invalid SESSION_KEYS:", err)
+	}
 	auth = spotifyauth.New(
 		spotifyauth.WithRedirectURL(redirectURL),
 		spotifyauth.WithScopes(
@@ -1219,7 +1535,6 @@ func main() {
 	)
 
 	app := NewApp()
-	go handleBroadcast()
 
 	r := mux.NewRouter()
 
@@ -1227,19 +1542,52 @@ func main() {
 	r.HandleFunc("/login", app.handleLogin).Methods("GET")
 	r.HandleFunc("/callback", app.handleCallback).Methods("GET")
 	r.HandleFunc("/logout", app.handleLogout).Methods("GET")
+	r.HandleFunc("/api/logout-all", app.handleLogoutAll).Methods("POST")
 	r.HandleFunc("/api/auth-status", app.handleGetAuthStatus).Methods("GET")
+	r.HandleFunc("/api/spotify/metrics", app.handleGetSpotifyMetrics).Methods("GET")
 	r.HandleFunc("/api/playlists", app.handleGetPlaylists).Methods("GET")
 	r.HandleFunc("/api/playlist/{id}/tracks", app.handleGetPlaylistTracks).Methods("GET")
-	r.HandleFunc("/api/vote", app.handleVote).Methods("POST")
-	r.HandleFunc("/api/play", app.handlePlayTrack).Methods("POST")
+	r.HandleFunc("/api/playlist/{id}/reorder", app.requireRole(RoleModerator, requestPlaylistID, app.handleReorderPlaylist)).Methods("POST")
+	r.HandleFunc("/api/playlist/{id}/reorder-schedule", app.handleGetReorderSchedule).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/reorder-schedule", app.requireRole(RoleModerator, requestPlaylistID, app.handleSetReorderSchedule)).Methods("PUT")
+	r.HandleFunc("/api/playlist/{id}/reorder-schedule", app.requireRole(RoleModerator, requestPlaylistID, app.handleDeleteReorderSchedule)).Methods("DELETE")
+	r.HandleFunc("/api/playlist/{id}/settings", app.handleGetPlaylistSettings).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/settings", app.requireRole(RoleOwner, requestPlaylistID, app.handleUpdatePlaylistSettings)).Methods("PUT")
+	r.HandleFunc("/api/playlist/{id}/tracks/{trackId}/history", app.handleGetTrackVoteHistory).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/stats/votes-per-hour", app.handleGetVotesPerHour).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/stats/controversial", app.handleGetControversialTracks).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/vote-check", app.requireRole(RoleOwner, requestPlaylistID, app.handleCheckVotes)).Methods("GET", "POST")
+	r.HandleFunc("/api/playlist/{id}/hot-reset", app.requireRole(RoleModerator, requestPlaylistID, app.handleResetHotScores)).Methods("POST")
+	r.HandleFunc("/api/playlist/{id}/throttled", app.requireRole(RoleModerator, requestPlaylistID, app.handleGetThrottled)).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/roles", app.handleGetRoles).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/roles/{userId}", app.requireRole(RoleOwner, requestPlaylistID, app.handleGrantRole)).Methods("PUT")
+	r.HandleFunc("/api/playlist/{id}/roles/{userId}", app.requireRole(RoleOwner, requestPlaylistID, app.handleRevokeRole)).Methods("DELETE")
+	r.HandleFunc("/api/playlist/{id}/suggestions", app.handleGetSuggestions).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/suggestions", app.rateLimit("suggestions", requestPlaylistID, app.requireRole(RoleVoter, requestPlaylistID, app.handleCreateSuggestion))).Methods("POST")
+	r.HandleFunc("/api/suggestions/{suggestionId}/vote", app.rateLimit("suggestions", app.suggestionPlaylistID, app.requireRole(RoleVoter, app.suggestionPlaylistID, app.handleVoteSuggestion))).Methods("POST")
+	r.HandleFunc("/api/search", app.rateLimit("search", nil, app.handleSearchTracks)).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/rules", app.handleGetRemovalRules).Methods("GET")
+	r.HandleFunc("/api/playlist/{id}/rules", app.requireRole(RoleModerator, requestPlaylistID, app.handleCreateRemovalRule)).Methods("POST")
+	r.HandleFunc("/api/playlist/{id}/rules/{ruleId}", app.requireRole(RoleModerator, requestPlaylistID, app.handleDeleteRemovalRule)).Methods("DELETE")
+	r.HandleFunc("/api/vote", app.rateLimit("vote", requestPlaylistID, app.requireRole(RoleVoter, requestPlaylistID, app.handleVote))).Methods("POST")
+	r.HandleFunc("/api/play", app.rateLimit("playback", requestPlaylistID, app.handlePlayTrack)).Methods("POST")
 	r.HandleFunc("/api/devices", app.handleGetDevices).Methods("GET")
-	r.HandleFunc("/api/delete-track", app.handleDeleteTrack).Methods("POST")
+	r.HandleFunc("/api/delete-track", app.rateLimit("delete-track", requestPlaylistID, app.requireRole(RoleModerator, requestPlaylistID, app.handleDeleteTrack))).Methods("POST")
 	r.HandleFunc("/api/deleted-tracks/{playlistId}", app.handleGetDeletedTracks).Methods("GET")
+	r.HandleFunc("/api/deleted-tracks/{playlistId}/{trackId}/restore", app.rateLimit("delete-track", requestPlaylistID, app.requireRole(RoleModerator, requestPlaylistID, app.handleRestoreDeletedTrack))).Methods("POST")
 	r.HandleFunc("/api/now-playing", app.handleGetNowPlaying).Methods("GET")
-	r.HandleFunc("/api/playback/play-pause", app.handlePlayPause).Methods("POST")
-	r.HandleFunc("/api/playback/next", app.handleNext).Methods("POST")
-	r.HandleFunc("/api/playback/previous", app.handlePrevious).Methods("POST")
-	r.HandleFunc("/ws", handleWebSocket)
+	r.HandleFunc("/api/playback/play-pause", app.rateLimit("playback", nil, app.handlePlayPause)).Methods("POST")
+	r.HandleFunc("/api/playback/next", app.rateLimit("playback", nil, app.handleNext)).Methods("POST")
+	r.HandleFunc("/api/playback/previous", app.rateLimit("playback", nil, app.handlePrevious)).Methods("POST")
+	r.HandleFunc("/api/autodj", app.handleGetAutoDJ).Methods("GET")
+	r.HandleFunc("/api/autodj/start", app.requireRole(RoleModerator, requestPlaylistID, app.handleStartAutoDJ)).Methods("POST")
+	r.HandleFunc("/api/autodj/stop", app.handleStopAutoDJ).Methods("POST")
+	r.HandleFunc("/api/rooms", app.requireRole(RoleModerator, requestPlaylistID, app.handleCreateRoom)).Methods("POST")
+	r.HandleFunc("/api/rooms/{code}", app.handleGetRoom).Methods("GET")
+	r.HandleFunc("/api/rooms/{code}", app.handleCloseRoom).Methods("DELETE")
+	r.HandleFunc("/api/rooms/{code}/join", app.rateLimit("join-room", nil, app.handleJoinRoom)).Methods("POST")
+	r.HandleFunc("/api/rooms/{code}/qr.png", app.handleRoomQRCode).Methods("GET")
+	r.HandleFunc("/ws", app.handleWebSocket)
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("./static"))
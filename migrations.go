@@ -0,0 +1,494 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sqlExecutor is what migrations and table setup need; both *sql.DB and
+// *sql.Tx satisfy it.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// A migration changes the schema from version-1 to version. Up must also work
+// on databases from before migrations were tracked, which may already have
+// some of its tables and columns; Down undoes it.
+type migration struct {
+	version int
+	name    string
+	up      func(tx sqlExecutor) error
+	down    func(tx sqlExecutor) error
+}
+
+// schema is the migration history of one database.
+type schema struct {
+	name       string
+	migrations []migration // oldest first
+	rebind     func(query string) string
+	// lock, if set, is run first in the migration transaction so instances
+	// starting at the same time don't migrate concurrently
+	lock string
+}
+
+// sqliteSchema is the local SQLite database: everything, including the
+// Store's tables when DATABASE_URL isn't set.
+var sqliteSchema = schema{
+	name:       "sqlite",
+	migrations: sqliteMigrations,
+	rebind:     func(query string) string { return query },
+}
+
+// sqliteMigrations is the SQLite schema history. Never change a migration
+// that has shipped; add a new one instead.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "votes, sessions, deleted tracks and user votes",
+		up: func(tx sqlExecutor) error {
+			// Re-key tables from before votes were scoped per playlist
+			if err := migrateToPlaylistScopedVotes(tx); err != nil {
+				return err
+			}
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS votes (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote_count INTEGER NOT NULL DEFAULT 0,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (playlist_id, track_id)
+				)`, `
+				CREATE TABLE IF NOT EXISTS sessions (
+					session_id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					access_token TEXT NOT NULL,
+					refresh_token TEXT,
+					token_expiry TIMESTAMP NOT NULL,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				)`, `
+				CREATE TABLE IF NOT EXISTS deleted_tracks (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					track_name TEXT NOT NULL,
+					track_artists TEXT NOT NULL,
+					track_album TEXT NOT NULL,
+					track_image_url TEXT,
+					track_uri TEXT NOT NULL,
+					votes_at_deletion INTEGER NOT NULL DEFAULT 0,
+					deleted_by TEXT NOT NULL,
+					deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (playlist_id, track_id)
+				)`, `
+				CREATE TABLE IF NOT EXISTS user_votes (
+					user_id TEXT NOT NULL,
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote INTEGER NOT NULL DEFAULT 0,
+					voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					PRIMARY KEY (user_id, playlist_id, track_id)
+				)`)
+		},
+		down: dropTables("user_votes", "deleted_tracks", "sessions", "votes"),
+	},
+	{
+		version: 2,
+		name:    "rooms for guest voting",
+		up:      createRoomTables,
+		down:    dropTables("room_guests", "rooms"),
+	},
+	{
+		version: 3,
+		name:    "reorder schedules",
+		up:      createReorderTables,
+		down:    dropTables("reorder_schedules"),
+	},
+	{
+		version: 4,
+		name:    "removal rules",
+		up:      createRuleTables,
+		down:    dropTables("removal_rules"),
+	},
+	{
+		version: 5,
+		name:    "restoring deleted tracks",
+		up: addColumns("deleted_tracks", []columnDefinition{
+			{"track_position", "INTEGER"},
+			{"restored_at", "TIMESTAMP"},
+			{"restored_by", "TEXT"},
+		}),
+		down: dropColumns("deleted_tracks", "track_position", "restored_at", "restored_by"),
+	},
+	{
+		version: 6,
+		name:    "playlist settings",
+		up:      createSettingsTables,
+		down:    dropTables("playlist_settings"),
+	},
+	{
+		version: 7,
+		name:    "track suggestions",
+		up:      createSuggestionTables,
+		down:    dropTables("suggestion_votes", "suggestions"),
+	},
+	{
+		version: 8,
+		name:    "playlist roles",
+		up:      createRoleTables,
+		down:    dropTables("playlist_roles"),
+	},
+	{
+		version: 9,
+		name:    "random session IDs and session activity",
+		up: func(tx sqlExecutor) error {
+			if err := addColumnIfMissing(tx, "sessions", "last_seen_at", "TIMESTAMP"); err != nil {
+				return err
+			}
+
+			// Sessions from before random IDs had guessable IDs (session-<unix nanos>)
+			result, err := tx.Exec("DELETE FROM sessions WHERE session_id LIKE 'session-%'")
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("🧹 Removed %d sessions with guessable IDs, those users need to log in again", n)
+			}
+			return nil
+		},
+		down: dropColumns("sessions", "last_seen_at"),
+	},
+	{
+		version: 10,
+		name:    "vote history",
+		up: func(tx sqlExecutor) error {
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS vote_events (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id TEXT NOT NULL,
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote INTEGER NOT NULL,
+					delta INTEGER NOT NULL,
+					total INTEGER NOT NULL,
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+				)`, `
+				CREATE INDEX IF NOT EXISTS vote_events_track ON vote_events (playlist_id, track_id, created_at)`, `
+				CREATE INDEX IF NOT EXISTS vote_events_playlist ON vote_events (playlist_id, created_at)`)
+		},
+		down: dropTables("vote_events"),
+	},
+	{
+		version: 11,
+		name:    "hot ranking settings",
+		up: addColumns("playlist_settings", []columnDefinition{
+			{"hot_half_life_hours", "REAL"},
+			{"hot_since", "TIMESTAMP"},
+			{"hot_reset_on_room", "INTEGER NOT NULL DEFAULT 0"},
+		}),
+		down: dropColumns("playlist_settings", "hot_half_life_hours", "hot_since", "hot_reset_on_room"),
+	},
+	{
+		version: 12,
+		name:    "voting policies",
+		up: func(tx sqlExecutor) error {
+			if err := addColumns("user_votes", []columnDefinition{
+				{"weight", "INTEGER NOT NULL DEFAULT 1"},
+				{"superlike", "INTEGER NOT NULL DEFAULT 0"},
+			})(tx); err != nil {
+				return err
+			}
+			return addColumns("playlist_settings", []columnDefinition{
+				{"upvote_budget", "INTEGER NOT NULL DEFAULT 0"},
+				{"superlike_budget", "INTEGER NOT NULL DEFAULT 0"},
+				{"budget_period_hours", "INTEGER NOT NULL DEFAULT 24"},
+				{"host_vote_weight", "INTEGER NOT NULL DEFAULT 1"},
+				{"superlike_weight", "INTEGER NOT NULL DEFAULT 3"},
+			})(tx)
+		},
+		down: func(tx sqlExecutor) error {
+			if err := dropColumns("user_votes", "weight", "superlike")(tx); err != nil {
+				return err
+			}
+			return dropColumns("playlist_settings", "upvote_budget", "superlike_budget",
+				"budget_period_hours", "host_vote_weight", "superlike_weight")(tx)
+		},
+	},
+}
+
+type columnDefinition struct{ name, definition string }
+
+func execAll(tx sqlExecutor, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropTables(tables ...string) func(tx sqlExecutor) error {
+	return func(tx sqlExecutor) error {
+		for _, table := range tables {
+			if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func addColumns(table string, columns []columnDefinition) func(tx sqlExecutor) error {
+	return func(tx sqlExecutor) error {
+		for _, column := range columns {
+			if err := addColumnIfMissing(tx, table, column.name, column.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func dropColumns(table string, columns ...string) func(tx sqlExecutor) error {
+	return func(tx sqlExecutor) error {
+		for _, column := range columns {
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (s schema) latest() int {
+	return s.migrations[len(s.migrations)-1].version
+}
+
+func createMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// appliedMigrations returns when each applied migration was applied, by version.
+func appliedMigrations(db sqlExecutor) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// beginMigration starts the transaction migrations run in and returns the
+// migrations applied so far.
+func beginMigration(db *sql.DB, s schema) (*sql.Tx, map[int]time.Time, error) {
+	if err := createMigrationsTable(db); err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.lock != "" {
+		if _, err := tx.Exec(s.lock); err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+	}
+
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return tx, applied, nil
+}
+
+// migrateUp applies all pending migrations up to and including target in one
+// transaction, so a failure leaves the schema as it was. It returns the
+// number of migrations applied.
+func migrateUp(db *sql.DB, s schema, target int) (int, error) {
+	tx, applied, err := beginMigration(db, s)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for _, m := range s.migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		log.Printf("📦 Applying %s migration %d: %s", s.name, m.version, m.name)
+		if err := m.up(tx); err != nil {
+			return 0, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(s.rebind(`
+			INSERT INTO schema_migrations (version, name) VALUES (?, ?)
+		`), m.version, m.name); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// migrateDown rolls back applied migrations newer than target, newest first,
+// in one transaction. It returns the number of migrations rolled back.
+func migrateDown(db *sql.DB, s schema, target int) (int, error) {
+	tx, applied, err := beginMigration(db, s)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for i := len(s.migrations) - 1; i >= 0; i-- {
+		m := s.migrations[i]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		log.Printf("↩️  Rolling back %s migration %d: %s", s.name, m.version, m.name)
+		if err := m.down(tx); err != nil {
+			return 0, fmt.Errorf("rolling back migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(s.rebind("DELETE FROM schema_migrations WHERE version = ?"), m.version); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// currentSchemaVersion is the newest applied migration, or 0.
+func currentSchemaVersion(applied map[int]time.Time) int {
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current
+}
+
+// runMigrate is the migrate command. It works on the SQLite database, or on
+// the Postgres store with "migrate postgres ...":
+//
+//	migrate [postgres] status         list migrations and whether they are applied
+//	migrate [postgres] up [version]   apply pending migrations (up to version)
+//	migrate [postgres] down [version] roll back to version (default: the previous one)
+func runMigrate(args []string) {
+	s := sqliteSchema
+	var db *sql.DB
+	var err error
+	if len(args) > 0 && args[0] == "postgres" {
+		args = args[1:]
+		s = postgresSchema
+		db, err = openPostgres(os.Getenv("DATABASE_URL"))
+	} else {
+		db, err = openDatabase()
+	}
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	if err := createMigrationsTable(db); err != nil {
+		log.Fatal("Failed to create schema_migrations:", err)
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		log.Fatal("Failed to read schema_migrations:", err)
+	}
+	current := currentSchemaVersion(applied)
+
+	target := -1
+	if len(args) > 1 {
+		target, err = strconv.Atoi(args[1])
+		if err != nil || target < 0 || target > s.latest() {
+			log.Fatalf("Version must be between 0 and %d", s.latest())
+		}
+	}
+
+	switch command {
+	case "status":
+		fmt.Printf("%s schema version %d (latest %d)\n", s.name, current, s.latest())
+		for _, m := range s.migrations {
+			status := "pending"
+			if appliedAt, ok := applied[m.version]; ok {
+				status = "applied " + appliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-45s %s\n", m.version, m.name, status)
+		}
+
+	case "up":
+		if target < 0 {
+			target = s.latest()
+		}
+		n, err := migrateUp(db, s, target)
+		if err != nil {
+			log.Fatal("Migration failed, nothing was changed: ", err)
+		}
+		log.Printf("✅ Applied %d migrations", n)
+
+	case "down":
+		if target < 0 {
+			target = current - 1
+			if target < 0 {
+				log.Fatal("No migrations to roll back")
+			}
+		}
+		n, err := migrateDown(db, s, target)
+		if err != nil {
+			log.Fatal("Rollback failed, nothing was changed: ", err)
+		}
+		log.Printf("✅ Rolled back %d migrations", n)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [postgres] [status | up [version] | down [version]]\n", os.Args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "votes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// sqliteColumns returns the columns of every table but schema_migrations, by
+// table.
+func sqliteColumns(t *testing.T, db *sql.DB) map[string][]string {
+	t.Helper()
+
+	rows, err := db.Query(`
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	columns := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			columns[table] = append(columns[table], name)
+		}
+		rows.Close()
+		sort.Strings(columns[table])
+	}
+	return columns
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return currentSchemaVersion(applied)
+}
+
+// Rolling back any migration and applying it again gives the same schema.
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	latest := sqliteSchema.latest()
+
+	for _, m := range sqliteMigrations {
+		t.Run(m.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+
+			if n, err := migrateUp(db, sqliteSchema, latest); err != nil || n != len(sqliteMigrations) {
+				t.Fatalf("migrateUp() = %d, %v, want %d migrations", n, err, len(sqliteMigrations))
+			}
+			want := sqliteColumns(t, db)
+
+			target := m.version - 1
+			rolledBack := 0
+			for _, other := range sqliteMigrations {
+				if other.version > target {
+					rolledBack++
+				}
+			}
+			if n, err := migrateDown(db, sqliteSchema, target); err != nil || n != rolledBack {
+				t.Fatalf("migrateDown(%d) = %d, %v, want %d migrations", target, n, err, rolledBack)
+			}
+			if got := schemaVersion(t, db); got != target {
+				t.Fatalf("version after migrateDown(%d) = %d", target, got)
+			}
+
+			if n, err := migrateUp(db, sqliteSchema, latest); err != nil || n != rolledBack {
+				t.Fatalf("migrateUp() again = %d, %v, want %d migrations", n, err, rolledBack)
+			}
+			if got := sqliteColumns(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("schema after the round trip = %v, want %v", got, want)
+			}
+			if got := schemaVersion(t, db); got != latest {
+				t.Errorf("version = %d, want %d", got, latest)
+			}
+		})
+	}
+}
+
+func TestSQLiteMigrationsDownToEmpty(t *testing.T) {
+	db := openTestDatabase(t)
+
+	if _, err := migrateUp(db, sqliteSchema, sqliteSchema.latest()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateDown(db, sqliteSchema, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := sqliteColumns(t, db); len(got) != 0 {
+		t.Errorf("tables left after rolling back everything: %v", got)
+	}
+	if got := schemaVersion(t, db); got != 0 {
+		t.Errorf("version = %d, want 0", got)
+	}
+
+	// Applying pending migrations again is a no-op
+	if _, err := migrateUp(db, sqliteSchema, sqliteSchema.latest()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := migrateUp(db, sqliteSchema, sqliteSchema.latest()); err != nil || n != 0 {
+		t.Errorf("migrateUp() on an up to date database = %d, %v, want 0", n, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Playlists are cached by Spotify's snapshot_id, which changes with every
+// change to the playlist: loading a cached playlist costs one small request
+// for the current snapshot_id instead of a page request per 100 tracks.
+
+// Playlists nobody loaded for this long are dropped from the cache.
+const playlistCacheIdleTimeout = time.Hour
+
+type cachedPlaylist struct {
+	snapshotID string
+	tracks     []Track
+	lastUsed   time.Time
+}
+
+type playlistCache struct {
+	mu        sync.Mutex
+	playlists map[string]*cachedPlaylist // playlistID -> tracks at snapshotID
+}
+
+// playlistTracks returns the playlist's tracks, from the cache if the playlist
+// didn't change since it was last fetched. The snapshot_id is always checked
+// with client, so only users who can see the playlist get its tracks.
+func (app *App) playlistTracks(ctx context.Context, client *spotify.Client, playlistID string) ([]Track, error) {
+	playlist, err := client.GetPlaylist(ctx, spotify.ID(playlistID), spotify.Fields("snapshot_id,owner.id"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The owner comes for free, see playlistOwner
+	app.owners.mu.Lock()
+	app.owners.owners[playlistID] = playlist.Owner.ID
+	app.owners.mu.Unlock()
+
+	now := time.Now()
+	app.playlists.mu.Lock()
+	cached, ok := app.playlists.playlists[playlistID]
+	if ok && cached.snapshotID == playlist.SnapshotID {
+		cached.lastUsed = now
+		tracks := append([]Track(nil), cached.tracks...)
+		app.playlists.mu.Unlock()
+		return tracks, nil
+	}
+	app.playlists.mu.Unlock()
+
+	tracks, err := fetchPlaylistTracks(ctx, client, spotify.ID(playlistID))
+	if err != nil {
+		return nil, err
+	}
+
+	// If the playlist changed again meanwhile, the next load sees a new
+	// snapshot_id and fetches it again
+	app.playlists.mu.Lock()
+	for id, p := range app.playlists.playlists {
+		if now.Sub(p.lastUsed) > playlistCacheIdleTimeout {
+			delete(app.playlists.playlists, id)
+		}
+	}
+	app.playlists.playlists[playlistID] = &cachedPlaylist{
+		snapshotID: playlist.SnapshotID,
+		tracks:     append([]Track(nil), tracks...),
+		lastUsed:   now,
+	}
+	app.playlists.mu.Unlock()
+
+	return tracks, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Rankings for ?rank= on the track listing
+const (
+	RankNet         = "net"         // upvotes minus downvotes
+	RankWilson      = "wilson"      // confidence that listeners like the track
+	RankControversy = "controversy" // many votes, split evenly
+	RankHot         = "hot"         // net votes, recent ones weighing more
+)
+
+// wilsonZ is the z-score for 95% confidence
+const wilsonZ = 1.96
+
+// requestRanking reads ?rank=, net by default.
+func requestRanking(r *http.Request) (string, error) {
+	switch rank := r.URL.Query().Get("rank"); rank {
+	case "":
+		return RankNet, nil
+	case RankNet, RankWilson, RankControversy, RankHot:
+		return rank, nil
+	default:
+		return "", fmt.Errorf("rank must be %s, %s, %s or %s", RankNet, RankWilson, RankControversy, RankHot)
+	}
+}
+
+// rankScore is a track's score under the ranking; higher ranks first. The
+// hot ranking needs the votes' ages, see hotScores.
+func rankScore(ranking string, net int, counts VoteCounts) float64 {
+	switch ranking {
+	case RankWilson:
+		return wilsonLowerBound(counts.Up, counts.Down)
+	case RankControversy:
+		return controversy(counts.Up, counts.Down)
+	default:
+		return float64(net)
+	}
+}
+
+// wilsonLowerBound is the lower bound of the Wilson score interval for the
+// share of upvotes, so 9 up and 1 down beats 1 up and 0 down.
+func wilsonLowerBound(up, down int) float64 {
+	n := float64(up + down)
+	if n == 0 {
+		return 0
+	}
+	p := float64(up) / n
+	z2 := wilsonZ * wilsonZ
+	return (p + z2/(2*n) - wilsonZ*math.Sqrt((p*(1-p)+z2/(4*n))/n)) / (1 + z2/n)
+}
+
+// controversy is high for tracks with many votes split evenly between up and
+// down: the number of votes raised to the balance between them (0 to 1).
+func controversy(up, down int) float64 {
+	if up <= 0 || down <= 0 {
+		return 0
+	}
+	balance := float64(min(up, down)) / float64(max(up, down))
+	return math.Pow(float64(up+down), balance)
+}
+
+// hotScores weighs each vote in the playlist by its age: a vote counts 1 when
+// it's cast and half as much every half-life after. Votes before the
+// playlist's HotSince don't count.
+func (app *App) hotScores(playlistID string, now time.Time) (map[string]float64, error) {
+	settings, err := app.getPlaylistSettings(playlistID)
+	if err != nil {
+		return nil, err
+	}
+	var since time.Time
+	if settings.HotSince != nil {
+		since = *settings.HotSince
+	}
+
+	votes, err := app.store.UserVotesSince(playlistID, since)
+	if err != nil {
+		return nil, err
+	}
+
+	halfLife := settings.HotHalfLifeHours
+	scores := make(map[string]float64)
+	for _, v := range votes {
+		ageHours := math.Max(0, now.Sub(v.VotedAt).Hours())
+		scores[v.TrackID] += float64(v.Vote) * math.Pow(0.5, ageHours/halfLife)
+	}
+	return scores, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRankScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranking string
+		net     int
+		counts  VoteCounts
+		want    float64
+	}{
+		{"net", RankNet, 4, VoteCounts{Up: 5, Down: 1}, 4},
+		{"net without votes", RankNet, 0, VoteCounts{}, 0},
+		{"wilson without votes", RankWilson, 0, VoteCounts{}, 0},
+		{"wilson one upvote", RankWilson, 1, VoteCounts{Up: 1}, 0.2065},
+		{"wilson only downvotes", RankWilson, -3, VoteCounts{Down: 3}, 0},
+		{"wilson 9 to 1", RankWilson, 8, VoteCounts{Up: 9, Down: 1}, 0.5958},
+		{"controversy even split", RankControversy, 0, VoteCounts{Up: 5, Down: 5}, 10},
+		{"controversy one sided", RankControversy, 10, VoteCounts{Up: 10}, 0},
+		{"controversy 1 to 3", RankControversy, -2, VoteCounts{Up: 1, Down: 3}, math.Cbrt(4)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rankScore(tt.ranking, tt.net, tt.counts); math.Abs(got-tt.want) > 1e-4 {
+				t.Errorf("rankScore() = %.4f, want %.4f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankingOrder(t *testing.T) {
+	tests := []struct {
+		name          string
+		ranking       string
+		higher, lower VoteCounts
+	}{
+		{"wilson trusts more votes", RankWilson, VoteCounts{Up: 9, Down: 1}, VoteCounts{Up: 1}},
+		{"wilson prefers the better share", RankWilson, VoteCounts{Up: 90, Down: 10}, VoteCounts{Up: 60, Down: 40}},
+		{"controversy prefers more votes", RankControversy, VoteCounts{Up: 20, Down: 20}, VoteCounts{Up: 5, Down: 5}},
+		{"controversy prefers the even split", RankControversy, VoteCounts{Up: 10, Down: 10}, VoteCounts{Up: 19, Down: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			higher := rankScore(tt.ranking, tt.higher.Up-tt.higher.Down, tt.higher)
+			lower := rankScore(tt.ranking, tt.lower.Up-tt.lower.Down, tt.lower)
+			if higher <= lower {
+				t.Errorf("%+v scores %.4f, not more than %+v at %.4f", tt.higher, higher, tt.lower, lower)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// Rate limits keep scripts from flooding votes or playback commands and from
+// burning the app's Spotify API quota. Each limited route has a token bucket
+// per user and one per client IP; a request needs a token from both.
+
+const (
+	rateLimitJanitorInterval = 5 * time.Minute
+
+	// Throttled requests kept for the throttle log, and how long repeated
+	// throttling of the same user on the same route adds up into one entry
+	maxThrottleEvents   = 200
+	throttleEventWindow = time.Minute
+)
+
+// bucketLimit is a token bucket: Rate requests per second on average, up to
+// Burst at once. The zero value means no limit.
+type bucketLimit struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+func (l bucketLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+func (l bucketLimit) String() string {
+	if !l.enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%g/m:%d", float64(l.Rate)*60, l.Burst)
+}
+
+// routeLimit are the buckets of a rate limited route. Guests at a party often
+// share the venue's IP, so the IP buckets are a lot bigger than the user ones.
+type routeLimit struct {
+	User bucketLimit
+	IP   bucketLimit
+}
+
+// Rate limits per route, see rateLimit. Each can be set with
+// RATE_LIMIT_<ROUTE>_USER and RATE_LIMIT_<ROUTE>_IP, e.g.
+// RATE_LIMIT_VOTE_USER="60/m:20" or "off".
+var rateLimits = map[string]routeLimit{
+	"vote": {
+		User: bucketLimit{Rate: 2, Burst: 20},
+		IP:   bucketLimit{Rate: 20, Burst: 100},
+	},
+	"playback": {
+		User: bucketLimit{Rate: 1, Burst: 5},
+		IP:   bucketLimit{Rate: 5, Burst: 20},
+	},
+	"delete-track": {
+		User: bucketLimit{Rate: rate.Every(2 * time.Second), Burst: 10},
+		IP:   bucketLimit{Rate: 1, Burst: 20},
+	},
+	"search": {
+		User: bucketLimit{Rate: 2, Burst: 10},
+		IP:   bucketLimit{Rate: 10, Burst: 40},
+	},
+	"suggestions": {
+		User: bucketLimit{Rate: 1, Burst: 10},
+		IP:   bucketLimit{Rate: 5, Burst: 30},
+	},
+	"join-room": {
+		IP: bucketLimit{Rate: rate.Every(2 * time.Second), Burst: 30},
+	},
+}
+
+// parseBucketLimit parses "<n>/<s|m|h>[:<burst>]" or "off". The burst
+// defaults to n.
+func parseBucketLimit(raw string) (bucketLimit, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "off" {
+		return bucketLimit{}, nil
+	}
+
+	spec, burstSpec, hasBurst := strings.Cut(raw, ":")
+	count, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return bucketLimit{}, fmt.Errorf("missing /unit")
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return bucketLimit{}, fmt.Errorf("invalid count %q", count)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return bucketLimit{}, fmt.Errorf("unit must be s, m or h")
+	}
+
+	burst := int(math.Ceil(n))
+	if hasBurst {
+		burst, err = strconv.Atoi(burstSpec)
+		if err != nil || burst <= 0 {
+			return bucketLimit{}, fmt.Errorf("invalid burst %q", burstSpec)
+		}
+	}
+	return bucketLimit{Rate: rate.Limit(n / per.Seconds()), Burst: burst}, nil
+}
+
+func loadRateLimits() error {
+	for route, limit := range rateLimits {
+		for _, setting := range []struct {
+			env   string
+			value *bucketLimit
+		}{
+			{rateLimitEnv(route, "USER"), &limit.User},
+			{rateLimitEnv(route, "IP"), &limit.IP},
+		} {
+			raw := os.Getenv(setting.env)
+			if raw == "" {
+				continue
+			}
+			parsed, err := parseBucketLimit(raw)
+			if err != nil {
+				return fmt.Errorf("%s must be like 60/m:20 or off: %v", setting.env, err)
+			}
+			*setting.value = parsed
+		}
+		rateLimits[route] = limit
+	}
+	return nil
+}
+
+func rateLimitEnv(route, bucket string) string {
+	return "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(route, "-", "_")) + "_" + bucket
+}
+
+// ThrottleEvent is a user or IP that ran out of requests on a route. Count
+// adds up repeated throttling within throttleEventWindow.
+type ThrottleEvent struct {
+	Time       time.Time `json:"time"`
+	LastTime   time.Time `json:"last_time"`
+	Route      string    `json:"route"`
+	Bucket     string    `json:"bucket"` // "user" or "ip"
+	UserID     string    `json:"user_id,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	IP         string    `json:"ip"`
+	PlaylistID string    `json:"playlist_id,omitempty"`
+	Count      int       `json:"count"`
+	RetryAfter int       `json:"retry_after"` // seconds, of the last throttled request
+}
+
+// rateLimiter holds the token buckets of all rate limited routes and the
+// most recent throttled requests.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter // route|user|id or route|ip|address -> bucket
+	throttled []ThrottleEvent          // oldest first
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*rate.Limiter)}
+}
+
+// reserve takes a token from the key's bucket. The reservation is nil when
+// the bucket has no limit.
+func (l *rateLimiter) reserve(key string, limit bucketLimit, now time.Time) *rate.Reservation {
+	if !limit.enabled() {
+		return nil
+	}
+
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(limit.Rate, limit.Burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	return bucket.ReserveN(now, 1)
+}
+
+// record adds a throttled request to the log, and reports whether it started
+// a new entry, i.e. whether it's worth logging.
+func (l *rateLimiter) record(event ThrottleEvent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := len(l.throttled) - 1; i >= 0; i-- {
+		last := &l.throttled[i]
+		if event.Time.Sub(last.LastTime) > throttleEventWindow {
+			break
+		}
+		if last.Route == event.Route && last.Bucket == event.Bucket && last.UserID == event.UserID && last.IP == event.IP {
+			last.LastTime = event.Time
+			last.Count++
+			last.RetryAfter = event.RetryAfter
+			return false
+		}
+	}
+
+	event.LastTime = event.Time
+	event.Count = 1
+	l.throttled = append(l.throttled, event)
+	if len(l.throttled) > maxThrottleEvents {
+		l.throttled = l.throttled[len(l.throttled)-maxThrottleEvents:]
+	}
+	return true
+}
+
+// throttledIn returns the playlist's throttle log, newest first.
+func (l *rateLimiter) throttledIn(playlistID string) []ThrottleEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := []ThrottleEvent{}
+	for i := len(l.throttled) - 1; i >= 0; i-- {
+		if l.throttled[i].PlaylistID == playlistID {
+			events = append(events, l.throttled[i])
+		}
+	}
+	return events
+}
+
+// dropFullBuckets forgets buckets that refilled: a new bucket starts full, so
+// nobody gets extra requests out of it.
+func (l *rateLimiter) dropFullBuckets(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dropped := 0
+	for key, bucket := range l.buckets {
+		if bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(l.buckets, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (app *App) dropFullRateLimitBucketsPeriodically() {
+	ticker := time.NewTicker(rateLimitJanitorInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		app.limiter.dropFullBuckets(now)
+	}
+}
+
+// clientIP is the address the request came from. On Fly.io the proxy puts it
+// in Fly-Client-IP; elsewhere forwarding headers can't be trusted.
+func clientIP(r *http.Request) string {
+	if os.Getenv("FLY_APP_NAME") != "" {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit lets the request through when the caller's user and IP buckets of
+// the route both have a token left, and answers 429 with Retry-After
+// otherwise. locate (optional) finds the playlist for the throttle log.
+func (app *App) rateLimit(route string, locate playlistLocator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := rateLimits[route]
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		ip := clientIP(r)
+
+		// Requests without a user only count against their IP; the handler
+		// turns them away anyway
+		var voter *Voter
+		var userReservation *rate.Reservation
+		if limit.User.enabled() {
+			if v, err := app.getVoter(r); err == nil {
+				voter = v
+				userReservation = app.limiter.reserve(route+"|user|"+v.UserID, limit.User, now)
+				r = withVoter(r, v)
+			}
+		}
+		ipReservation := app.limiter.reserve(route+"|ip|"+ip, limit.IP, now)
+
+		bucket, delay := "", time.Duration(0)
+		for _, res := range []struct {
+			bucket      string
+			reservation *rate.Reservation
+		}{
+			{"user", userReservation},
+			{"ip", ipReservation},
+		} {
+			if res.reservation == nil {
+				continue
+			}
+			if d := res.reservation.DelayFrom(now); d > delay {
+				bucket, delay = res.bucket, d
+			}
+		}
+
+		if delay == 0 {
+			next(w, r)
+			return
+		}
+
+		// Give the tokens back, the request isn't served
+		for _, reservation := range []*rate.Reservation{userReservation, ipReservation} {
+			if reservation != nil {
+				reservation.CancelAt(now)
+			}
+		}
+
+		retryAfter := int(math.Ceil(delay.Seconds()))
+		event := ThrottleEvent{Time: now, Route: route, Bucket: bucket, IP: ip, RetryAfter: retryAfter}
+		if voter != nil {
+			event.UserID, event.Name = voter.UserID, voter.Name
+		}
+		if locate != nil {
+			event.PlaylistID, _ = locate(r)
+		}
+		if app.limiter.record(event) {
+			who := ip
+			if voter != nil {
+				who = fmt.Sprintf("%s (%s)", voter.Name, ip)
+			}
+			log.Printf("🚦 Throttled %s on %s (%s limit), retry in %ds", who, route, bucket, retryAfter)
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+	}
+}
+
+// handleGetThrottled returns the playlist's recently throttled users, newest
+// first.
+func (app *App) handleGetThrottled(w http.ResponseWriter, r *http.Request) {
+	playlistID := mux.Vars(r)["id"]
+
+	limits := map[string]map[string]string{}
+	for route, limit := range rateLimits {
+		limits[route] = map[string]string{"user": limit.User.String(), "ip": limit.IP.String()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"throttled": app.limiter.throttledIn(playlistID),
+		"limits":    limits,
+	})
+}
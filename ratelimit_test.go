@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParseBucketLimit(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    bucketLimit
+		wantErr bool
+	}{
+		{"off", bucketLimit{}, false},
+		{" off ", bucketLimit{}, false},
+		{"60/m", bucketLimit{Rate: 1, Burst: 60}, false},
+		{"60/m:20", bucketLimit{Rate: 1, Burst: 20}, false},
+		{"2/s:5", bucketLimit{Rate: 2, Burst: 5}, false},
+		{"1800/h:10", bucketLimit{Rate: 0.5, Burst: 10}, false},
+		{"0.5/s", bucketLimit{Rate: 0.5, Burst: 1}, false},
+		{"60", bucketLimit{}, true},
+		{"60/d", bucketLimit{}, true},
+		{"0/m", bucketLimit{}, true},
+		{"-1/m", bucketLimit{}, true},
+		{"many/m", bucketLimit{}, true},
+		{"60/m:0", bucketLimit{}, true},
+		{"60/m:lots", bucketLimit{}, true},
+		{"", bucketLimit{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseBucketLimit(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketLimit(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseBucketLimit(%q) = %+v, want %+v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	saved := make(map[string]routeLimit)
+	for route, limit := range rateLimits {
+		saved[route] = limit
+	}
+	t.Cleanup(func() { rateLimits = saved })
+
+	t.Setenv("RATE_LIMIT_VOTE_USER", "30/m:10")
+	t.Setenv("RATE_LIMIT_JOIN_ROOM_IP", "off")
+
+	if err := loadRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rateLimits["vote"].User, (bucketLimit{Rate: 0.5, Burst: 10}); got != want {
+		t.Errorf("vote user limit = %+v, want %+v", got, want)
+	}
+	if got := rateLimits["vote"].IP; got != saved["vote"].IP {
+		t.Errorf("vote IP limit changed to %+v", got)
+	}
+	if got := rateLimits["join-room"].IP; got.enabled() {
+		t.Errorf("join-room IP limit = %+v, want off", got)
+	}
+
+	t.Setenv("RATE_LIMIT_SEARCH_IP", "fast")
+	if err := loadRateLimits(); err == nil {
+		t.Error("loadRateLimits() accepted RATE_LIMIT_SEARCH_IP=fast")
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := bucketLimit{Rate: rate.Every(time.Minute), Burst: 2}
+	now := time.Now()
+
+	for i, wantDelay := range []bool{false, false, true} {
+		delay := limiter.reserve("vote|user|u1", limit, now).DelayFrom(now)
+		if (delay > 0) != wantDelay {
+			t.Errorf("request %d delay = %v, want delay %v", i+1, delay, wantDelay)
+		}
+	}
+
+	// Other users and disabled limits aren't affected
+	if delay := limiter.reserve("vote|user|u2", limit, now).DelayFrom(now); delay > 0 {
+		t.Errorf("other user delayed by %v", delay)
+	}
+	if reservation := limiter.reserve("vote|ip|1.2.3.4", bucketLimit{}, now); reservation != nil {
+		t.Error("reservation on a disabled limit")
+	}
+
+	// Buckets are dropped once they refilled
+	if dropped := limiter.dropFullBuckets(now.Add(time.Hour)); dropped != 2 {
+		t.Errorf("dropFullBuckets() = %d, want 2", dropped)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	minReorderInterval   = 5 * time.Minute
+	reorderCheckInterval = time.Minute
+	reorderTimeout       = 2 * time.Minute
+)
+
+func createReorderTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS reorder_schedules (
+			playlist_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			interval_minutes INTEGER NOT NULL,
+			last_run_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// reorderPlaylist moves the playlist's items on Spotify so its order matches
+// the vote ranking (ties keep their current relative order). Items are moved
+// in place, so they keep when and by whom they were added, and a failed move
+// leaves every item in the playlist. It returns false if the playlist was
+// already in ranking order.
+func (app *App) reorderPlaylist(ctx context.Context, session *UserSession, playlistID string) (bool, error) {
+	playlist, err := session.Client.GetPlaylist(ctx, spotify.ID(playlistID), spotify.Fields("snapshot_id,tracks.total"))
+	if err != nil {
+		return false, err
+	}
+
+	tracks, err := fetchPlaylistTracks(ctx, session.Client, spotify.ID(playlistID))
+	if err != nil {
+		return false, err
+	}
+
+	// Moves address items by position, which is off if we can't see them all
+	if len(tracks) != int(playlist.Tracks.Total) {
+		return false, fmt.Errorf("playlist contains episodes or unavailable items, refusing to reorder")
+	}
+	for _, track := range tracks {
+		if track.ID == "" {
+			return false, fmt.Errorf("playlist contains local files, refusing to reorder")
+		}
+	}
+
+	totals, err := app.store.VoteTotals(playlistID)
+	if err != nil {
+		return false, err
+	}
+	for i := range tracks {
+		tracks[i].Votes = totals[tracks[i].ID]
+	}
+
+	ranked := make([]Track, len(tracks))
+	copy(ranked, tracks)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Votes > ranked[j].Votes
+	})
+
+	changed := false
+	for i := range tracks {
+		if tracks[i].ID != ranked[i].ID {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// Bring the ranked tracks to the front one run at a time: find where the
+	// next ranked track is now and move it, along with the ranked tracks
+	// already following it, in front of everything not placed yet
+	current := make([]string, len(tracks))
+	for i, track := range tracks {
+		current[i] = track.ID
+	}
+	snapshotID := playlist.SnapshotID
+	moves := 0
+	for i := 0; i < len(ranked); {
+		from := i
+		for current[from] != ranked[i].ID {
+			from++
+		}
+		length := 1
+		for from+length < len(current) && current[from+length] == ranked[i+length].ID {
+			length++
+		}
+		if from == i {
+			i += length
+			continue
+		}
+
+		snapshotID, err = session.Client.ReorderPlaylistTracks(ctx, spotify.ID(playlistID), spotify.PlaylistReorderOptions{
+			RangeStart:   spotify.Numeric(from),
+			RangeLength:  spotify.Numeric(length),
+			InsertBefore: spotify.Numeric(i),
+			SnapshotID:   snapshotID,
+		})
+		if err != nil {
+			return moves > 0, fmt.Errorf("moving playlist items %d-%d to %d: %w", from, from+length, i, err)
+		}
+		moves++
+
+		run := append([]string{}, current[from:from+length]...)
+		copy(current[i+length:from+length], current[i:from])
+		copy(current[i:], run)
+		i += length
+	}
+
+	log.Printf("🔀 Reordered playlist %s by votes (%d moves)", playlistID, moves)
+	return true, nil
+}
+
+func (app *App) handleReorderPlaylist(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	changed, err := app.reorderPlaylist(r.Context(), userSession, playlistID)
+	if err != nil {
+		log.Printf("❌ Failed to reorder playlist %s for %s: %v", playlistID, userSession.UserID, err)
+		http.Error(w, fmt.Sprintf("Failed to reorder playlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"success": true,
+		"changed": changed,
+	})
+}
+
+func (app *App) handleGetReorderSchedule(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.getSession(r); err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	var userID string
+	var interval int
+	var lastRun sql.NullTime
+	err := app.db.QueryRow(`
+		SELECT user_id, interval_minutes, last_run_at
+		FROM reorder_schedules WHERE playlist_id = ?
+	`, playlistID).Scan(&userID, &interval, &lastRun)
+
+	response := map[string]interface{}{"enabled": err == nil}
+	if err == nil {
+		response["user_id"] = userID
+		response["interval_minutes"] = interval
+		if lastRun.Valid {
+			response["last_run_at"] = lastRun.Time
+		}
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to get reorder schedule: %v", err)
+		http.Error(w, "Failed to get reorder schedule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (app *App) handleSetReorderSchedule(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	var req struct {
+		IntervalMinutes int `json:"interval_minutes"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if time.Duration(req.IntervalMinutes)*time.Minute < minReorderInterval {
+		http.Error(w, fmt.Sprintf("interval_minutes must be at least %d", int(minReorderInterval.Minutes())), http.StatusBadRequest)
+		return
+	}
+
+	// The job runs with the Spotify account of whoever scheduled it
+	_, err = app.db.Exec(`
+		INSERT INTO reorder_schedules (playlist_id, user_id, interval_minutes)
+		VALUES (?, ?, ?)
+		ON CONFLICT(playlist_id)
+		DO UPDATE SET user_id = ?, interval_minutes = ?
+	`, playlistID, userSession.UserID, req.IntervalMinutes, userSession.UserID, req.IntervalMinutes)
+	if err != nil {
+		log.Printf("Failed to save reorder schedule: %v", err)
+		http.Error(w, "Failed to save reorder schedule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("⏰ User %s scheduled reordering of playlist %s every %d minutes",
+		userSession.UserID, playlistID, req.IntervalMinutes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":          true,
+		"interval_minutes": req.IntervalMinutes,
+	})
+}
+
+func (app *App) handleDeleteReorderSchedule(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	if _, err := app.db.Exec("DELETE FROM reorder_schedules WHERE playlist_id = ?", playlistID); err != nil {
+		log.Printf("Failed to delete reorder schedule: %v", err)
+		http.Error(w, "Failed to delete reorder schedule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("⏰ User %s removed the reorder schedule of playlist %s", userSession.UserID, playlistID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": false})
+}
+
+// runReorderSchedulesPeriodically reorders every playlist whose schedule is due.
+func (app *App) runReorderSchedulesPeriodically() {
+	ticker := time.NewTicker(reorderCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := app.db.Query(`
+			SELECT playlist_id, user_id, interval_minutes, last_run_at
+			FROM reorder_schedules
+		`)
+		if err != nil {
+			log.Printf("⚠️  Failed to load reorder schedules: %v", err)
+			continue
+		}
+
+		type job struct {
+			playlistID string
+			userID     string
+		}
+		due := []job{}
+		for rows.Next() {
+			var j job
+			var interval int
+			var lastRun sql.NullTime
+			if err := rows.Scan(&j.playlistID, &j.userID, &interval, &lastRun); err != nil {
+				log.Printf("⚠️  Error scanning reorder schedule: %v", err)
+				continue
+			}
+			if !lastRun.Valid || time.Since(lastRun.Time) >= time.Duration(interval)*time.Minute {
+				due = append(due, j)
+			}
+		}
+		rows.Close()
+
+		for _, j := range due {
+			session := app.sessionForUser(j.userID)
+			if session == nil {
+				log.Printf("⚠️  Skipping scheduled reorder of %s: %s is not logged in", j.playlistID, j.userID)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), reorderTimeout)
+			if _, err := app.reorderPlaylist(ctx, session, j.playlistID); err != nil {
+				log.Printf("⚠️  Scheduled reorder of %s failed: %v", j.playlistID, err)
+			}
+			cancel()
+
+			if _, err := app.db.Exec(`
+				UPDATE reorder_schedules SET last_run_at = CURRENT_TIMESTAMP WHERE playlist_id = ?
+			`, j.playlistID); err != nil {
+				log.Printf("⚠️  Failed to update reorder schedule: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify/v2"
+)
+
+// playlistItemPosition returns the index of the first item with the given URI
+// in the playlist, or -1 if it isn't there. Episodes and local files count
+// towards the position, like they do on Spotify.
+func playlistItemPosition(ctx context.Context, client *spotify.Client, playlistID, uri string) (int, error) {
+	offset := 0
+	limit := 100
+
+	for {
+		page, err := client.GetPlaylistItems(ctx, spotify.ID(playlistID), spotify.Limit(limit), spotify.Offset(offset))
+		if err != nil {
+			return -1, err
+		}
+
+		for i, item := range page.Items {
+			if item.Track.Track != nil && string(item.Track.Track.URI) == uri {
+				return offset + i, nil
+			}
+		}
+
+		if len(page.Items) < limit {
+			return -1, nil
+		}
+		offset += limit
+	}
+}
+
+// trackPosition is playlistItemPosition served from the playlist cache, see
+// playlistTracks: while the playlist is unchanged it costs one small request
+// instead of a page request per 100 tracks. It scans the playlist only if the
+// cache can't be used.
+func (app *App) trackPosition(ctx context.Context, client *spotify.Client, playlistID, uri string) (int, error) {
+	tracks, err := app.playlistTracks(ctx, client, playlistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to load playlist %s, scanning it for %s: %v", playlistID, uri, err)
+		return playlistItemPosition(ctx, client, playlistID, uri)
+	}
+	for _, track := range tracks {
+		if track.URI == uri {
+			return track.Position, nil
+		}
+	}
+	return -1, nil
+}
+
+// addTrackToPlaylist adds uri to the playlist on Spotify, at position or at
+// the end when position is negative. The library's AddTracksToPlaylist can't
+// insert at a position, so this calls the Web API directly.
+func addTrackToPlaylist(ctx context.Context, userSession *UserSession, playlistID, uri string, position int) error {
+	requestBody := map[string]interface{}{
+		"uris": []string{uri},
+	}
+	if position >= 0 {
+		requestBody["position"] = position
+	}
+
+	bodyBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		return err
+	}
+
+	apiURL := fmt.Sprintf("https://api.spotify.com/v1/playlists/%s/tracks", playlistID)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := userSession.HTTPClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return &spotifyAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+func (app *App) handleRestoreDeletedTrack(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	key := trackKey{PlaylistID: vars["playlistId"], TrackID: vars["trackId"]}
+
+	var req struct {
+		// Put the track back where it was instead of at the end
+		RestorePosition bool `json:"restore_position"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, found, err := app.store.DeletedTrack(key)
+	if err != nil {
+		log.Printf("Failed to get deleted track: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Deleted track not found", http.StatusNotFound)
+		return
+	}
+	uri := deleted.URI
+
+	ctx := r.Context()
+
+	insertAt := -1
+	if req.RestorePosition && deleted.Position != nil {
+		insertAt = *deleted.Position
+
+		// The playlist may have shrunk since; Spotify rejects positions past the end
+		playlist, err := userSession.Client.GetPlaylist(ctx, spotify.ID(key.PlaylistID), spotify.Fields("tracks.total"))
+		if err != nil {
+			log.Printf("⚠️  Failed to get playlist %s for %s: %v", key.PlaylistID, userSession.UserID, err)
+			http.Error(w, "Failed to get playlist", spotifyErrorStatus(err))
+			return
+		}
+		insertAt = min(insertAt, int(playlist.Tracks.Total))
+	}
+
+	err = addTrackToPlaylist(ctx, userSession, key.PlaylistID, uri, insertAt)
+	var apiErr *spotifyAPIError
+	if errors.As(err, &apiErr) {
+		log.Printf("❌ Spotify API error: %d - %s", apiErr.StatusCode, apiErr.Body)
+		http.Error(w, apiErr.Error(), apiErr.StatusCode)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to restore track for %s: %v", userSession.UserID, err)
+		http.Error(w, fmt.Sprintf("Failed to restore track: %v", err), spotifyErrorStatus(err))
+		return
+	}
+
+	if err := app.store.MarkTrackRestored(key, userSession.UserID); err != nil {
+		log.Printf("⚠️  Failed to mark track %s as restored: %v", key.TrackID, err)
+	}
+
+	// The user votes outlive the removal: recount them, rather than writing
+	// back the total at removal, so votes cast since aren't lost
+	votes, err := app.store.RepairVotes(key)
+	if err != nil {
+		log.Printf("⚠️  Failed to recount votes for track %s: %v", key.TrackID, err)
+		votes = deleted.Votes
+	} else {
+		app.publishTrackVotes(key, votes)
+	}
+
+	app.hub.Publish(Message{
+		Type:       MessageTrackRestored,
+		PlaylistID: key.PlaylistID,
+		Data: TrackRestored{
+			TrackID:    key.TrackID,
+			URI:        uri,
+			Position:   insertAt,
+			RestoredBy: userSession.UserID,
+		},
+	})
+
+	log.Printf("♻️  User %s restored track %s to playlist %s (position: %d, votes: %d)",
+		userSession.UserID, key.TrackID, key.PlaylistID, insertAt, votes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"votes":    votes,
+		"position": insertAt,
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Per-playlist roles, from least to most privileged. Each role can do
+// everything the roles before it can.
+const (
+	RoleViewer    = "viewer"    // see the playlist and votes
+	RoleVoter     = "voter"     // vote and suggest tracks
+	RoleModerator = "moderator" // remove/restore tracks, manage rooms and rules
+	RoleOwner     = "owner"     // change settings and grant roles
+)
+
+// Users without a grant can vote, like before roles existed.
+const defaultRole = RoleVoter
+
+var roleRanks = map[string]int{
+	RoleViewer:    1,
+	RoleVoter:     2,
+	RoleModerator: 3,
+	RoleOwner:     4,
+}
+
+const playlistOwnerTimeout = 10 * time.Second
+
+// RoleGrant is a role given to a user on a playlist.
+type RoleGrant struct {
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	GrantedBy string    `json:"granted_by"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// playlistOwners caches the Spotify owner of each playlist, which is always
+// an owner in the app too.
+type playlistOwners struct {
+	mu     sync.Mutex
+	owners map[string]string // playlistID -> Spotify user ID
+}
+
+func createRoleTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS playlist_roles (
+			playlist_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			granted_by TEXT NOT NULL,
+			granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (playlist_id, user_id)
+		)
+	`)
+	return err
+}
+
+// playlistOwner returns the Spotify user ID of the playlist's owner.
+func (app *App) playlistOwner(ctx context.Context, session *UserSession, playlistID string) (string, error) {
+	app.owners.mu.Lock()
+	owner, ok := app.owners.owners[playlistID]
+	app.owners.mu.Unlock()
+	if ok {
+		return owner, nil
+	}
+
+	playlist, err := session.Client.GetPlaylist(ctx, spotify.ID(playlistID), spotify.Fields("owner.id"))
+	if err != nil {
+		return "", err
+	}
+
+	app.owners.mu.Lock()
+	app.owners.owners[playlistID] = playlist.Owner.ID
+	app.owners.mu.Unlock()
+	return playlist.Owner.ID, nil
+}
+
+// roleFor returns the voter's role on a playlist: owner for the playlist's
+// Spotify owner, otherwise whatever was granted, otherwise defaultRole.
+func (app *App) roleFor(ctx context.Context, voter *Voter, playlistID string) (string, error) {
+	if !voter.IsGuest() {
+		owner, err := app.playlistOwner(ctx, voter.Session, playlistID)
+		if err != nil {
+			// Private playlists of other users can't be read; they just aren't the owner
+			log.Printf("⚠️  Failed to get owner of playlist %s: %v", playlistID, err)
+		} else if owner == voter.UserID {
+			return RoleOwner, nil
+		}
+	}
+
+	role, granted, err := app.store.PlaylistRole(playlistID, voter.UserID)
+	if err != nil {
+		return "", err
+	}
+	if !granted {
+		return defaultRole, nil
+	}
+	return role, nil
+}
+
+func roleAtLeast(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// playlistLocator finds the playlist a request acts on.
+type playlistLocator func(r *http.Request) (string, error)
+
+// requestPlaylistID looks for the playlist in the route ({id} or
+// {playlistId}), the playlist_id query parameter, then a playlist_id field in
+// the JSON body. The body is put back for the handler to decode.
+func requestPlaylistID(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+	if id := vars["id"]; id != "" {
+		return id, nil
+	}
+	if id := vars["playlistId"]; id != "" {
+		return id, nil
+	}
+	if id := r.URL.Query().Get("playlist_id"); id != "" {
+		return id, nil
+	}
+
+	if r.Body == nil {
+		return "", fmt.Errorf("playlist_id is required")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		PlaylistID string `json:"playlist_id"`
+	}
+	if len(body) > 0 {
+		json.Unmarshal(body, &req)
+	}
+	if req.PlaylistID == "" {
+		return "", fmt.Errorf("playlist_id is required")
+	}
+	return req.PlaylistID, nil
+}
+
+// suggestionPlaylistID finds the playlist of the {suggestionId} in the route.
+func (app *App) suggestionPlaylistID(r *http.Request) (string, error) {
+	suggestionID, err := strconv.ParseInt(mux.Vars(r)["suggestionId"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid suggestion ID")
+	}
+	var playlistID string
+	if err := app.db.QueryRow("SELECT playlist_id FROM suggestions WHERE id = ?", suggestionID).Scan(&playlistID); err != nil {
+		return "", fmt.Errorf("suggestion not found")
+	}
+	return playlistID, nil
+}
+
+// requireRole only lets the request through when the caller has at least the
+// required role on the playlist it acts on.
+func (app *App) requireRole(required string, locate playlistLocator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		voter, err := app.getVoter(r)
+		if err != nil {
+			http.Error(w, "Not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		playlistID, err := locate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), playlistOwnerTimeout)
+		role, err := app.roleFor(ctx, voter, playlistID)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get role: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if !roleAtLeast(role, required) {
+			log.Printf("🚫 %s (%s) tried %s %s on playlist %s", voter.Name, role, r.Method, r.URL.Path, playlistID)
+			http.Error(w, fmt.Sprintf("This requires the %s role on this playlist", required), http.StatusForbidden)
+			return
+		}
+
+		next(w, withVoter(r, voter))
+	}
+}
+
+func (app *App) handleGetRoles(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	myRole, err := app.roleFor(r.Context(), voter, playlistID)
+	if err != nil {
+		log.Printf("Failed to get role: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	grants, err := app.store.PlaylistRoles(playlistID)
+	if err != nil {
+		log.Printf("Failed to get roles: %v", err)
+		http.Error(w, "Failed to get roles", http.StatusInternalServerError)
+		return
+	}
+
+	app.owners.mu.Lock()
+	owner := app.owners.owners[playlistID]
+	app.owners.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"my_role":       myRole,
+		"spotify_owner": owner,
+		"default_role":  defaultRole,
+		"granted_roles": grants,
+	})
+}
+
+func (app *App) handleGrantRole(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	playlistID, userID := vars["id"], vars["userId"]
+
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := roleRanks[req.Role]; !ok {
+		http.Error(w, "role must be owner, moderator, voter or viewer", http.StatusBadRequest)
+		return
+	}
+
+	if app.isSpotifyOwner(playlistID, userID) {
+		http.Error(w, "The playlist's Spotify owner is always an owner", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.store.GrantRole(playlistID, userID, req.Role, voter.UserID); err != nil {
+		log.Printf("Failed to grant role: %v", err)
+		http.Error(w, "Failed to grant role", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 %s made %s a %s of playlist %s", voter.Name, userID, req.Role, playlistID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"user_id": userID,
+		"role":    req.Role,
+	})
+}
+
+func (app *App) handleRevokeRole(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	playlistID, userID := vars["id"], vars["userId"]
+
+	if app.isSpotifyOwner(playlistID, userID) {
+		http.Error(w, "The playlist's Spotify owner is always an owner", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := app.store.RevokeRole(playlistID, userID)
+	if err != nil {
+		log.Printf("Failed to revoke role: %v", err)
+		http.Error(w, "Failed to revoke role", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "No role granted to this user", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("🔑 %s revoked the role of %s on playlist %s", voter.Name, userID, playlistID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"user_id": userID,
+		"role":    defaultRole,
+	})
+}
+
+// isSpotifyOwner reports whether userID owns the playlist on Spotify, as far
+// as the cache knows. Grant and revoke are owner-only, so the caller's role
+// check has already filled the cache.
+func (app *App) isSpotifyOwner(playlistID, userID string) bool {
+	app.owners.mu.Lock()
+	defer app.owners.mu.Unlock()
+	return app.owners.owners[playlistID] == userID
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// roomCodeAlphabet leaves out characters that are easy to confuse when a code
+// is read out loud or copied from a screen (0/O, 1/I/L).
+const roomCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+const roomCodeLength = 6
+
+// Room binds a host's playlist to a short join code. Guests join a room with
+// only a nickname and vote on its playlist; everything that needs Spotify
+// (reading the playlist, playback, deleting) goes through the host's session.
+type Room struct {
+	Code       string    `json:"code"`
+	PlaylistID string    `json:"playlist_id"`
+	HostUserID string    `json:"host_user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Voter is whoever is casting votes: either a Spotify user with their own
+// session, or a guest who joined a room with a nickname.
+type Voter struct {
+	UserID  string       // Spotify user ID, or "guest:<id>" for guests
+	Name    string       // Display name (nickname for guests)
+	Session *UserSession // nil for guests
+	Room    *Room        // Room the guest joined, nil for Spotify users
+}
+
+func (v *Voter) IsGuest() bool {
+	return v.Session == nil
+}
+
+func guestUserID(guestID string) string {
+	return "guest:" + guestID
+}
+
+func createRoomTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS rooms (
+			code TEXT PRIMARY KEY,
+			playlist_id TEXT NOT NULL,
+			host_user_id TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			closed_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS room_guests (
+			guest_id TEXT PRIMARY KEY,
+			room_code TEXT NOT NULL,
+			nickname TEXT NOT NULL,
+			joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+func generateRoomCode() (string, error) {
+	code := make([]byte, roomCodeLength)
+	alphabetSize := big.NewInt(int64(len(roomCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code[i] = roomCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+func generateGuestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// publicBaseURL is the externally reachable address of the app, derived from
+// the OAuth redirect URL.
+func publicBaseURL() string {
+	return strings.TrimSuffix(redirectURL, "/callback")
+}
+
+func roomJoinURL(code string) string {
+	return fmt.Sprintf("%s/?room=%s", publicBaseURL(), code)
+}
+
+// getRoom returns the open room with the code. Rooms live in the Store, so a
+// guest can use any instance.
+func (app *App) getRoom(code string) (*Room, error) {
+	room, found, err := app.store.Room(strings.ToUpper(code))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("room not found")
+	}
+	return &room, nil
+}
+
+// sessionForUser returns the most recently refreshed session of a Spotify user,
+// or nil if they aren't logged in anywhere.
+func (app *App) sessionForUser(userID string) *UserSession {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+
+	var found *UserSession
+	for _, session := range app.sessions {
+		if session.UserID != userID {
+			continue
+		}
+		if found == nil || session.LastRefresh.After(found.LastRefresh) {
+			found = session
+		}
+	}
+	return found
+}
+
+// hostSession returns the Spotify session of the room's host.
+func (app *App) hostSession(room *Room) (*UserSession, error) {
+	session := app.sessionForUser(room.HostUserID)
+	if session == nil {
+		return nil, fmt.Errorf("host of room %s is not logged in", room.Code)
+	}
+	return session, nil
+}
+
+// voterContextKey holds the caller once a middleware identified them, so the
+// handler doesn't look up their session again.
+type voterContextKey struct{}
+
+// withVoter returns the request carrying the identified caller.
+func withVoter(r *http.Request, voter *Voter) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), voterContextKey{}, voter))
+}
+
+// getVoter identifies the caller as either a logged-in Spotify user or a
+// guest that joined a room.
+func (app *App) getVoter(r *http.Request) (*Voter, error) {
+	if voter, ok := r.Context().Value(voterContextKey{}).(*Voter); ok {
+		return voter, nil
+	}
+	if userSession, err := app.getSession(r); err == nil {
+		return &Voter{UserID: userSession.UserID, Name: userSession.UserID, Session: userSession}, nil
+	}
+
+	session, err := store.Get(r, "spotify-session")
+	if err != nil {
+		return nil, err
+	}
+
+	guestID, _ := session.Values["guest_id"].(string)
+	code, _ := session.Values["room_code"].(string)
+	if guestID == "" || code == "" {
+		return nil, fmt.Errorf("not authenticated")
+	}
+
+	room, err := app.getRoom(code)
+	if err != nil {
+		return nil, err
+	}
+
+	nickname, found, err := app.store.RoomGuest(guestID, room.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("guest not found")
+	}
+
+	return &Voter{UserID: guestUserID(guestID), Name: nickname, Room: room}, nil
+}
+
+// sessionForPlaylist returns the Spotify session to use when voter reads
+// playlistID: their own for Spotify users, the host's for guests of a room
+// bound to that playlist.
+func (app *App) sessionForPlaylist(voter *Voter, playlistID string) (*UserSession, error) {
+	if !voter.IsGuest() {
+		return voter.Session, nil
+	}
+	if voter.Room.PlaylistID != playlistID {
+		return nil, fmt.Errorf("guests can only access their room's playlist")
+	}
+	return app.hostSession(voter.Room)
+}
+
+func (app *App) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		PlaylistID string `json:"playlist_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.PlaylistID == "" {
+		http.Error(w, "playlist_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Reuse the host's open room for this playlist so the code stays stable
+	room, found, err := app.store.HostRoom(req.PlaylistID, userSession.UserID)
+	code := room.Code
+
+	if err == nil && !found {
+		for attempt := 0; attempt < 5; attempt++ {
+			code, err = generateRoomCode()
+			if err != nil {
+				break
+			}
+			err = app.store.CreateRoom(code, req.PlaylistID, userSession.UserID)
+			if err == nil {
+				log.Printf("🚪 User %s opened room %s for playlist %s", userSession.UserID, code, req.PlaylistID)
+				app.resetHotScoresForRoom(req.PlaylistID, userSession.UserID)
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed to create room: %v", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":        code,
+		"playlist_id": req.PlaylistID,
+		"join_url":    roomJoinURL(code),
+		"qr_url":      fmt.Sprintf("/api/rooms/%s/qr.png", code),
+	})
+}
+
+func (app *App) handleGetRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := app.getRoom(mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	guests, err := app.store.RoomGuestCount(room.Code)
+	if err != nil {
+		log.Printf("Failed to count room guests: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":         room.Code,
+		"playlist_id":  room.PlaylistID,
+		"host_user_id": room.HostUserID,
+		"created_at":   room.CreatedAt,
+		"join_url":     roomJoinURL(room.Code),
+		"guests":       guests,
+	})
+}
+
+func (app *App) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := app.getRoom(mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Nickname string `json:"nickname"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nickname := strings.TrimSpace(req.Nickname)
+	if nickname == "" || len(nickname) > 32 {
+		http.Error(w, "Nickname must be between 1 and 32 characters", http.StatusBadRequest)
+		return
+	}
+
+	guestID, err := generateGuestID()
+	if err != nil {
+		http.Error(w, "Failed to join room", http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.store.AddRoomGuest(guestID, room.Code, nickname); err != nil {
+		log.Printf("Failed to save room guest: %v", err)
+		http.Error(w, "Failed to join room", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, "spotify-session")
+	session.Values["guest_id"] = guestID
+	session.Values["room_code"] = room.Code
+	if err := session.Save(r, w); err != nil {
+		log.Printf("⚠️  Session save error: %v", err)
+	}
+
+	log.Printf("🙋 Guest %s joined room %s", nickname, room.Code)
+
+	app.hub.Publish(Message{
+		Type:       MessageUserJoined,
+		PlaylistID: room.PlaylistID,
+		Data:       UserJoined{Nickname: nickname, RoomCode: room.Code},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":        room.Code,
+		"playlist_id": room.PlaylistID,
+		"nickname":    nickname,
+	})
+}
+
+func (app *App) handleCloseRoom(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	room, err := app.getRoom(mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if room.HostUserID != userSession.UserID {
+		http.Error(w, "Only the host can close this room", http.StatusForbidden)
+		return
+	}
+
+	if err := app.store.CloseRoom(room.Code); err != nil {
+		log.Printf("Failed to close room: %v", err)
+		http.Error(w, "Failed to close room", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🚪 User %s closed room %s", userSession.UserID, room.Code)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (app *App) handleRoomQRCode(w http.ResponseWriter, r *http.Request) {
+	room, err := app.getRoom(mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	png, err := qrcode.Encode(roomJoinURL(room.Code), qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("Failed to generate QR code: %v", err)
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
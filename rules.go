@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Kinds of removal rules.
+const (
+	RuleMinScore      = "min_score"      // remove once the score is at or below Threshold
+	RuleDownvoteRatio = "downvote_ratio" // remove once more than Threshold of active voters downvoted it while active
+)
+
+const (
+	// Voters count as active when they voted on the playlist this recently
+	activeVoterWindow = 24 * time.Hour
+
+	// Keeps a single downvote from removing a track from a quiet playlist
+	defaultRuleMinVoters = 3
+
+	ruleRemovalTimeout = 30 * time.Second
+)
+
+// RemovalRule removes a track from a playlist automatically once its votes
+// cross a threshold. Removals are done with the Spotify account of the user
+// who created the rule.
+type RemovalRule struct {
+	ID         int64     `json:"id"`
+	PlaylistID string    `json:"playlist_id"`
+	Name       string    `json:"name"`
+	Kind       string    `json:"kind"`
+	Threshold  float64   `json:"threshold"`
+	MinVoters  int       `json:"min_voters"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ruleRemovals are the tracks whose rules are being applied, so concurrent
+// downvotes don't remove and record the same track twice.
+type ruleRemovals struct {
+	mu       sync.Mutex
+	inFlight map[trackKey]bool
+}
+
+func createRuleTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS removal_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			playlist_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			threshold REAL NOT NULL,
+			min_voters INTEGER NOT NULL DEFAULT 0,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(playlist_id, name)
+		)
+	`)
+	return err
+}
+
+func (app *App) getRemovalRules(playlistID string) ([]RemovalRule, error) {
+	rows, err := app.db.Query(`
+		SELECT id, playlist_id, name, kind, threshold, min_voters, created_by, created_at
+		FROM removal_rules
+		WHERE playlist_id = ?
+		ORDER BY id
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []RemovalRule{}
+	for rows.Next() {
+		var rule RemovalRule
+		if err := rows.Scan(&rule.ID, &rule.PlaylistID, &rule.Name, &rule.Kind,
+			&rule.Threshold, &rule.MinVoters, &rule.CreatedBy, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// ruleMatches reports whether a track with the given score breaks the rule.
+func (app *App) ruleMatches(rule RemovalRule, key trackKey, score int) (bool, error) {
+	switch rule.Kind {
+	case RuleMinScore:
+		// Rules saved before thresholds had to be negative
+		if rule.Threshold >= 0 {
+			return false, nil
+		}
+		return float64(score) <= rule.Threshold, nil
+	case RuleDownvoteRatio:
+		since := time.Now().Add(-activeVoterWindow)
+		activeVoters, err := app.store.ActiveVoters(key.PlaylistID, since)
+		if err != nil {
+			return false, err
+		}
+		if activeVoters == 0 || activeVoters < rule.MinVoters {
+			return false, nil
+		}
+		// Only downvotes from the same window: older ones were cast by
+		// voters who may not be counted as active anymore
+		counts, err := app.store.TrackVoteCountsSince(key, since)
+		if err != nil {
+			return false, err
+		}
+		return float64(counts.Down)/float64(activeVoters) > rule.Threshold, nil
+	}
+	return false, nil
+}
+
+// applyRemovalRules removes the track if any of its playlist's rules match.
+// It runs after the vote was answered, since removing a track takes several
+// Spotify calls; subscribers hear about the removal over the WebSocket.
+func (app *App) applyRemovalRules(key trackKey) {
+	rules, err := app.getRemovalRules(key.PlaylistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to load removal rules for %s: %v", key.PlaylistID, err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	// Another downvote is already applying the rules to this track
+	app.removals.mu.Lock()
+	if app.removals.inFlight[key] {
+		app.removals.mu.Unlock()
+		return
+	}
+	app.removals.inFlight[key] = true
+	app.removals.mu.Unlock()
+
+	defer func() {
+		app.removals.mu.Lock()
+		delete(app.removals.inFlight, key)
+		app.removals.mu.Unlock()
+	}()
+
+	// Already removed (by hand or by an earlier vote)
+	if _, deleted, err := app.store.DeletedTrack(key); err != nil || deleted {
+		return
+	}
+
+	// The score may have moved since the vote
+	score, err := app.store.VoteTotal(key)
+	if err != nil {
+		log.Printf("⚠️  Failed to get votes of %s: %v", key.TrackID, err)
+		return
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		matched, err := app.ruleMatches(*rule, key, score)
+		if err != nil {
+			log.Printf("⚠️  Failed to evaluate rule %q on %s: %v", rule.Name, key.TrackID, err)
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		session := app.sessionForUser(rule.CreatedBy)
+		if session == nil {
+			log.Printf("⚠️  Rule %q matched %s but %s is not logged in", rule.Name, key.TrackID, rule.CreatedBy)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ruleRemovalTimeout)
+		err = app.removeTrackByRule(ctx, session, key, rule)
+		cancel()
+		if err != nil {
+			log.Printf("⚠️  Rule %q failed to remove %s: %v", rule.Name, key.TrackID, err)
+			continue
+		}
+		return
+	}
+}
+
+func (app *App) removeTrackByRule(ctx context.Context, session *UserSession, key trackKey, rule *RemovalRule) error {
+	fullTrack, err := session.Client.GetTrack(ctx, spotify.ID(key.TrackID))
+	if err != nil {
+		return fmt.Errorf("getting track: %w", err)
+	}
+	track := trackFromSpotify(fullTrack)
+
+	return app.removeTrackFromPlaylist(ctx, session, RemovedTrack{
+		PlaylistID: key.PlaylistID,
+		TrackID:    key.TrackID,
+		URI:        track.URI,
+		Name:       track.Name,
+		Artists:    track.Artists,
+		Album:      track.Album,
+		ImageURL:   track.ImageURL,
+	}, "rule:"+rule.Name)
+}
+
+func (app *App) handleGetRemovalRules(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.getSession(r); err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	rules, err := app.getRemovalRules(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Failed to get removal rules: %v", err)
+		http.Error(w, "Failed to get removal rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (app *App) handleCreateRemovalRule(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	var req struct {
+		Name      string   `json:"name"`
+		Kind      string   `json:"kind"`
+		Threshold *float64 `json:"threshold"`
+		MinVoters *int     `json:"min_voters,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(w, "name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	// There's no default threshold: a missing one would be read as 0
+	if req.Threshold == nil {
+		http.Error(w, "threshold is required", http.StatusBadRequest)
+		return
+	}
+	threshold := *req.Threshold
+
+	minVoters := 0
+	switch req.Kind {
+	case RuleMinScore:
+		// At 0 or above, taking back an upvote could remove a track
+		if threshold >= 0 {
+			http.Error(w, "threshold must be negative for min_score", http.StatusBadRequest)
+			return
+		}
+	case RuleDownvoteRatio:
+		if threshold <= 0 || threshold >= 1 {
+			http.Error(w, "threshold must be between 0 and 1 for downvote_ratio", http.StatusBadRequest)
+			return
+		}
+		minVoters = defaultRuleMinVoters
+		if req.MinVoters != nil {
+			minVoters = *req.MinVoters
+		}
+	default:
+		http.Error(w, "kind must be min_score or downvote_ratio", http.StatusBadRequest)
+		return
+	}
+
+	_, err = app.db.Exec(`
+		INSERT INTO removal_rules (playlist_id, name, kind, threshold, min_voters, created_by)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(playlist_id, name)
+		DO UPDATE SET kind = ?, threshold = ?, min_voters = ?, created_by = ?
+	`, playlistID, req.Name, req.Kind, threshold, minVoters, userSession.UserID,
+		req.Kind, threshold, minVoters, userSession.UserID)
+	if err != nil {
+		log.Printf("Failed to save removal rule: %v", err)
+		http.Error(w, "Failed to save removal rule", http.StatusInternalServerError)
+		return
+	}
+
+	rule := RemovalRule{
+		PlaylistID: playlistID,
+		Name:       req.Name,
+		Kind:       req.Kind,
+		Threshold:  threshold,
+		MinVoters:  minVoters,
+		CreatedBy:  userSession.UserID,
+	}
+	err = app.db.QueryRow(`
+		SELECT id, created_at FROM removal_rules WHERE playlist_id = ? AND name = ?
+	`, playlistID, req.Name).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to read back removal rule: %v", err)
+	}
+
+	log.Printf("📏 User %s set removal rule %q (%s %.2f) on playlist %s",
+		userSession.UserID, req.Name, req.Kind, threshold, playlistID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (app *App) handleDeleteRemovalRule(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	ruleID, err := strconv.ParseInt(vars["ruleId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := app.db.Exec(`
+		DELETE FROM removal_rules WHERE id = ? AND playlist_id = ?
+	`, ruleID, vars["id"])
+	if err != nil {
+		log.Printf("Failed to delete removal rule: %v", err)
+		http.Error(w, "Failed to delete removal rule", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("📏 User %s removed rule %d from playlist %s", userSession.UserID, ruleID, vars["id"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	fallbackSuggestionThreshold = 3
+
+	defaultHotHalfLifeHours = 24
+	maxHotHalfLifeHours     = 365 * 24
+
+	defaultBudgetPeriodHours = 24
+	defaultSuperlikeWeight   = 3
+	maxVoteWeight            = 10
+)
+
+// PlaylistSettings holds the per-playlist options hosts can change. Playlists
+// without a row in playlist_settings use the defaults.
+type PlaylistSettings struct {
+	PlaylistID string `json:"playlist_id"`
+
+	// Net votes a suggestion needs before it is added to the playlist
+	SuggestionThreshold int `json:"suggestion_threshold"`
+
+	// In the hot ranking a vote counts half after this many hours
+	HotHalfLifeHours float64 `json:"hot_half_life_hours"`
+	// Votes cast before this don't count in the hot ranking; nil counts all
+	HotSince *time.Time `json:"hot_since"`
+	// Reset the hot ranking whenever a room is opened for the playlist
+	HotResetOnRoom bool `json:"hot_reset_on_room"`
+
+	// Voting policy, see votepolicy.go. Each user may have UpvoteBudget
+	// upvotes (0: unlimited) and SuperlikeBudget superlikes (0: none) cast in
+	// the last BudgetPeriodHours standing.
+	UpvoteBudget      int `json:"upvote_budget"`
+	SuperlikeBudget   int `json:"superlike_budget"`
+	BudgetPeriodHours int `json:"budget_period_hours"`
+	// What votes of owners and moderators count
+	HostVoteWeight int `json:"host_vote_weight"`
+	// What a superlike counts, times the host weight for hosts
+	SuperlikeWeight int `json:"superlike_weight"`
+}
+
+func createSettingsTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS playlist_settings (
+			playlist_id TEXT PRIMARY KEY,
+			suggestion_threshold INTEGER NOT NULL,
+			updated_by TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// defaultSuggestionThreshold can be set with the SUGGESTION_THRESHOLD
+// environment variable.
+func defaultSuggestionThreshold() int {
+	if value := os.Getenv("SUGGESTION_THRESHOLD"); value != "" {
+		if threshold, err := strconv.Atoi(value); err == nil && threshold > 0 {
+			return threshold
+		}
+		log.Printf("⚠️  Ignoring invalid SUGGESTION_THRESHOLD %q", value)
+	}
+	return fallbackSuggestionThreshold
+}
+
+func defaultPlaylistSettings(playlistID string) PlaylistSettings {
+	return PlaylistSettings{
+		PlaylistID:          playlistID,
+		SuggestionThreshold: defaultSuggestionThreshold(),
+		HotHalfLifeHours:    defaultHotHalfLifeHours,
+		BudgetPeriodHours:   defaultBudgetPeriodHours,
+		HostVoteWeight:      1,
+		SuperlikeWeight:     defaultSuperlikeWeight,
+	}
+}
+
+func (app *App) getPlaylistSettings(playlistID string) (PlaylistSettings, error) {
+	settings := defaultPlaylistSettings(playlistID)
+
+	var halfLife sql.NullFloat64
+	var hotSince sql.NullTime
+	err := app.db.QueryRow(`
+		SELECT suggestion_threshold, hot_half_life_hours, hot_since, hot_reset_on_room,
+		       upvote_budget, superlike_budget, budget_period_hours, host_vote_weight, superlike_weight
+		FROM playlist_settings WHERE playlist_id = ?
+	`, playlistID).Scan(&settings.SuggestionThreshold, &halfLife, &hotSince, &settings.HotResetOnRoom,
+		&settings.UpvoteBudget, &settings.SuperlikeBudget, &settings.BudgetPeriodHours,
+		&settings.HostVoteWeight, &settings.SuperlikeWeight)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+	if halfLife.Valid {
+		settings.HotHalfLifeHours = halfLife.Float64
+	}
+	if hotSince.Valid {
+		settings.HotSince = &hotSince.Time
+	}
+	return settings, nil
+}
+
+func (app *App) savePlaylistSettings(settings PlaylistSettings, updatedBy string) error {
+	var hotSince interface{}
+	if settings.HotSince != nil {
+		hotSince = sqliteTime(*settings.HotSince)
+	}
+
+	_, err := app.db.Exec(`
+		INSERT INTO playlist_settings (playlist_id, suggestion_threshold, hot_half_life_hours, hot_since, hot_reset_on_room,
+			upvote_budget, superlike_budget, budget_period_hours, host_vote_weight, superlike_weight, updated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(playlist_id)
+		DO UPDATE SET suggestion_threshold = excluded.suggestion_threshold,
+			hot_half_life_hours = excluded.hot_half_life_hours,
+			hot_since = excluded.hot_since,
+			hot_reset_on_room = excluded.hot_reset_on_room,
+			upvote_budget = excluded.upvote_budget,
+			superlike_budget = excluded.superlike_budget,
+			budget_period_hours = excluded.budget_period_hours,
+			host_vote_weight = excluded.host_vote_weight,
+			superlike_weight = excluded.superlike_weight,
+			updated_by = excluded.updated_by,
+			updated_at = CURRENT_TIMESTAMP
+	`, settings.PlaylistID, settings.SuggestionThreshold, settings.HotHalfLifeHours, hotSince,
+		settings.HotResetOnRoom, settings.UpvoteBudget, settings.SuperlikeBudget, settings.BudgetPeriodHours,
+		settings.HostVoteWeight, settings.SuperlikeWeight, updatedBy)
+	return err
+}
+
+// resetHotScores makes the hot ranking of the playlist start over: only votes
+// cast from now on count.
+func (app *App) resetHotScores(playlistID, resetBy string) (PlaylistSettings, error) {
+	settings, err := app.getPlaylistSettings(playlistID)
+	if err != nil {
+		return settings, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	settings.HotSince = &now
+	if err := app.savePlaylistSettings(settings, resetBy); err != nil {
+		return settings, err
+	}
+
+	log.Printf("🔥 %s reset the hot ranking of playlist %s", resetBy, playlistID)
+	return settings, nil
+}
+
+// resetHotScoresForRoom resets the playlist's hot ranking when a room is
+// opened for it, if the playlist is set up to.
+func (app *App) resetHotScoresForRoom(playlistID, openedBy string) {
+	settings, err := app.getPlaylistSettings(playlistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to get settings of playlist %s: %v", playlistID, err)
+		return
+	}
+	if !settings.HotResetOnRoom {
+		return
+	}
+	if _, err := app.resetHotScores(playlistID, openedBy); err != nil {
+		log.Printf("⚠️  Failed to reset hot ranking of playlist %s: %v", playlistID, err)
+	}
+}
+
+func (app *App) handleGetPlaylistSettings(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.getVoter(r); err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	settings, err := app.getPlaylistSettings(mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Failed to get playlist settings: %v", err)
+		http.Error(w, "Failed to get playlist settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (app *App) handleUpdatePlaylistSettings(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	settings, err := app.getPlaylistSettings(playlistID)
+	if err != nil {
+		log.Printf("Failed to get playlist settings: %v", err)
+		http.Error(w, "Failed to get playlist settings", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the fields present in the request are changed
+	var req struct {
+		SuggestionThreshold *int     `json:"suggestion_threshold,omitempty"`
+		HotHalfLifeHours    *float64 `json:"hot_half_life_hours,omitempty"`
+		HotResetOnRoom      *bool    `json:"hot_reset_on_room,omitempty"`
+		UpvoteBudget        *int     `json:"upvote_budget,omitempty"`
+		SuperlikeBudget     *int     `json:"superlike_budget,omitempty"`
+		BudgetPeriodHours   *int     `json:"budget_period_hours,omitempty"`
+		HostVoteWeight      *int     `json:"host_vote_weight,omitempty"`
+		SuperlikeWeight     *int     `json:"superlike_weight,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.SuggestionThreshold != nil {
+		if *req.SuggestionThreshold < 1 {
+			http.Error(w, "suggestion_threshold must be at least 1", http.StatusBadRequest)
+			return
+		}
+		settings.SuggestionThreshold = *req.SuggestionThreshold
+	}
+
+	if req.HotHalfLifeHours != nil {
+		if *req.HotHalfLifeHours <= 0 || *req.HotHalfLifeHours > maxHotHalfLifeHours {
+			http.Error(w, fmt.Sprintf("hot_half_life_hours must be between 0 and %d", maxHotHalfLifeHours), http.StatusBadRequest)
+			return
+		}
+		settings.HotHalfLifeHours = *req.HotHalfLifeHours
+	}
+
+	if req.HotResetOnRoom != nil {
+		settings.HotResetOnRoom = *req.HotResetOnRoom
+	}
+
+	for _, field := range []struct {
+		name     string
+		value    *int
+		min, max int
+		setting  *int
+	}{
+		{"upvote_budget", req.UpvoteBudget, 0, 10000, &settings.UpvoteBudget},
+		{"superlike_budget", req.SuperlikeBudget, 0, 10000, &settings.SuperlikeBudget},
+		{"budget_period_hours", req.BudgetPeriodHours, 1, 365 * 24, &settings.BudgetPeriodHours},
+		{"host_vote_weight", req.HostVoteWeight, 1, maxVoteWeight, &settings.HostVoteWeight},
+		{"superlike_weight", req.SuperlikeWeight, 1, maxVoteWeight, &settings.SuperlikeWeight},
+	} {
+		if field.value == nil {
+			continue
+		}
+		if *field.value < field.min || *field.value > field.max {
+			http.Error(w, fmt.Sprintf("%s must be between %d and %d", field.name, field.min, field.max), http.StatusBadRequest)
+			return
+		}
+		*field.setting = *field.value
+	}
+
+	if err := app.savePlaylistSettings(settings, userSession.UserID); err != nil {
+		log.Printf("Failed to save playlist settings: %v", err)
+		http.Error(w, "Failed to save playlist settings", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("⚙️  User %s updated settings of playlist %s", userSession.UserID, playlistID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// handleResetHotScores starts the playlist's hot ranking over, e.g. at the
+// start of a party.
+func (app *App) handleResetHotScores(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	settings, err := app.resetHotScores(mux.Vars(r)["id"], voter.UserID)
+	if err != nil {
+		log.Printf("Failed to reset hot ranking: %v", err)
+		http.Error(w, "Failed to reset hot ranking", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+	"golang.org/x/oauth2"
+)
+
+// All Spotify calls, the library's and the raw Web API ones, go through
+// spotifyTransport: it retries requests Spotify throttled (429) or failed
+// (5xx, network errors), waiting as long as Spotify asks or backing off
+// exponentially, and gives up when the request's context ends.
+
+const (
+	spotifyMaxRetries     = 3
+	spotifyRetryBaseDelay = 500 * time.Millisecond
+	spotifyRetryMaxDelay  = 8 * time.Second
+
+	// Longer waits than this would outlast the server's write timeout, the
+	// 429 is passed on instead
+	spotifyMaxRetryAfter = 10 * time.Second
+)
+
+// spotifyHTTPClient is the base client of every Spotify client, see
+// spotifyContext.
+var spotifyHTTPClient = &http.Client{Transport: &spotifyTransport{base: http.DefaultTransport, metrics: &spotifyMetrics}}
+
+// spotifyContext makes OAuth2 clients and token requests created with the
+// context use spotifyHTTPClient underneath.
+func spotifyContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, spotifyHTTPClient)
+}
+
+// retryMetrics counts what spotifyTransport did since startup.
+type retryMetrics struct {
+	requests      atomic.Int64 // requests sent to Spotify, retries included
+	retries       atomic.Int64
+	rateLimited   atomic.Int64 // 429 responses
+	serverErrors  atomic.Int64 // 5xx responses
+	networkErrors atomic.Int64
+	gaveUp        atomic.Int64 // failed after the last retry or with a too long Retry-After
+	canceled      atomic.Int64 // context ended while waiting to retry
+	waitedMillis  atomic.Int64
+}
+
+var spotifyMetrics retryMetrics
+
+// RetryMetrics is a snapshot of retryMetrics.
+type RetryMetrics struct {
+	Requests      int64   `json:"requests"`
+	Retries       int64   `json:"retries"`
+	RateLimited   int64   `json:"rate_limited"`
+	ServerErrors  int64   `json:"server_errors"`
+	NetworkErrors int64   `json:"network_errors"`
+	GaveUp        int64   `json:"gave_up"`
+	Canceled      int64   `json:"canceled"`
+	WaitedSeconds float64 `json:"waited_seconds"`
+}
+
+func (m *retryMetrics) snapshot() RetryMetrics {
+	return RetryMetrics{
+		Requests:      m.requests.Load(),
+		Retries:       m.retries.Load(),
+		RateLimited:   m.rateLimited.Load(),
+		ServerErrors:  m.serverErrors.Load(),
+		NetworkErrors: m.networkErrors.Load(),
+		GaveUp:        m.gaveUp.Load(),
+		Canceled:      m.canceled.Load(),
+		WaitedSeconds: float64(m.waitedMillis.Load()) / 1000,
+	}
+}
+
+type spotifyTransport struct {
+	base    http.RoundTripper
+	metrics *retryMetrics
+}
+
+func (t *spotifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attemptReq := req
+
+	for attempt := 0; ; attempt++ {
+		t.metrics.requests.Add(1)
+		resp, err := t.base.RoundTrip(attemptReq)
+
+		delay, retry := t.retryDelay(req, resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+
+		// Requests with a body can only be retried if it can be read again
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+		}
+		log.Printf("⏳ Spotify %s %s failed (%s), retry %d/%d in %v", req.Method, req.URL.Path, reason, attempt+1, spotifyMaxRetries, delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			t.metrics.canceled.Add(1)
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		t.metrics.retries.Add(1)
+		t.metrics.waitedMillis.Add(delay.Milliseconds())
+
+		attemptReq = req.Clone(ctx)
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+// retryDelay decides whether a failed attempt is retried and after how long.
+// Throttled requests are always retried, Spotify didn't act on them; others
+// only if repeating them is safe, e.g. not skipping to the next track.
+func (t *spotifyTransport) retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	switch {
+	case err != nil:
+		if req.Context().Err() != nil {
+			return 0, false
+		}
+		t.metrics.networkErrors.Add(1)
+		if !idempotent(req.Method) {
+			return 0, false
+		}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		t.metrics.rateLimited.Add(1)
+	case resp.StatusCode >= 500:
+		t.metrics.serverErrors.Add(1)
+		if !idempotent(req.Method) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if attempt >= spotifyMaxRetries {
+		t.metrics.gaveUp.Add(1)
+		return 0, false
+	}
+
+	delay := backoff(attempt)
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if retryAfter > spotifyMaxRetryAfter {
+				t.metrics.gaveUp.Add(1)
+				return 0, false
+			}
+			delay = retryAfter + jitter(spotifyRetryBaseDelay)
+		}
+	}
+	return delay, true
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoff doubles the wait with every attempt up to spotifyRetryMaxDelay, and
+// picks a random point in its upper half so clients don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	delay := spotifyRetryBaseDelay << attempt
+	if delay > spotifyRetryMaxDelay {
+		delay = spotifyRetryMaxDelay
+	}
+	return delay/2 + jitter(delay/2)
+}
+
+func jitter(upTo time.Duration) time.Duration {
+	if upTo <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(upTo) + 1))
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// errSpotifyStatus is the HTTP status of a failed Spotify call, 0 if Spotify
+// didn't answer.
+func errSpotifyStatus(err error) int {
+	var apiErr *spotifyAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	var libErr spotify.Error
+	if errors.As(err, &libErr) {
+		return libErr.Status
+	}
+	return 0
+}
+
+// handleGetSpotifyMetrics reports how often Spotify calls were retried.
+func (app *App) handleGetSpotifyMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, err := app.getVoter(r); err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spotifyMetrics.snapshot())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 8; attempt++ {
+		ceiling := spotifyRetryBaseDelay << attempt
+		if ceiling > spotifyRetryMaxDelay {
+			ceiling = spotifyRetryMaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			if delay := backoff(attempt); delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt, delay, ceiling/2, ceiling)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// An HTTP date in the future waits until then
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got, ok := parseRetryAfter(at); !ok || got <= 50*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, %v, want about a minute", at, got, ok)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	response := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+	networkErr := errors.New("connection reset")
+
+	tests := []struct {
+		name      string
+		method    string
+		resp      *http.Response
+		err       error
+		attempt   int
+		wantRetry bool
+		minDelay  time.Duration
+		maxDelay  time.Duration
+	}{
+		{"success", "GET", response(200, ""), nil, 0, false, 0, 0},
+		{"client error", "GET", response(404, ""), nil, 0, false, 0, 0},
+		{"throttled", "GET", response(429, "2"), nil, 0, true, 2 * time.Second, 2*time.Second + spotifyRetryBaseDelay},
+		{"throttled POST", "POST", response(429, "1"), nil, 0, true, time.Second, time.Second + spotifyRetryBaseDelay},
+		{"throttled without Retry-After", "GET", response(429, ""), nil, 1, true, spotifyRetryBaseDelay, 2 * spotifyRetryBaseDelay},
+		{"throttled too long", "GET", response(429, "60"), nil, 0, false, 0, 0},
+		{"server error", "PUT", response(503, ""), nil, 0, true, spotifyRetryBaseDelay / 2, spotifyRetryBaseDelay},
+		{"server error POST", "POST", response(502, ""), nil, 0, false, 0, 0},
+		{"network error", "GET", nil, networkErr, 2, true, 2 * spotifyRetryBaseDelay, 4 * spotifyRetryBaseDelay},
+		{"network error POST", "POST", nil, networkErr, 0, false, 0, 0},
+		{"last attempt", "GET", response(500, ""), nil, spotifyMaxRetries, false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &spotifyTransport{metrics: &retryMetrics{}}
+			req := httptest.NewRequest(tt.method, "https://api.spotify.com/v1/me/player/next", nil)
+
+			delay, retry := transport.retryDelay(req, tt.resp, tt.err, tt.attempt)
+			if retry != tt.wantRetry {
+				t.Fatalf("retryDelay() retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if retry && (delay < tt.minDelay || delay > tt.maxDelay) {
+				t.Errorf("retryDelay() = %v, want between %v and %v", delay, tt.minDelay, tt.maxDelay)
+			}
+		})
+	}
+
+	t.Run("canceled request", func(t *testing.T) {
+		transport := &spotifyTransport{metrics: &retryMetrics{}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "https://api.spotify.com/v1/me", nil).WithContext(ctx)
+
+		if _, retry := transport.retryDelay(req, nil, ctx.Err(), 0); retry {
+			t.Error("retryDelay() retries a canceled request")
+		}
+	})
+}
@@ -53,4 +53,4 @@ echo "Server will be available at: http://localhost:8080"
 echo "Press Ctrl+C to stop"
 echo ""
 
-go run main.go
+go run .
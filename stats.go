@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultStatsHours = 24
+	maxStatsHours     = 30 * 24
+
+	defaultControversialLimit = 10
+	maxControversialLimit     = 50
+)
+
+// ScorePoint is a track's total right after a vote.
+type ScorePoint struct {
+	Time  time.Time `json:"time"`
+	Votes int       `json:"votes"`
+}
+
+// HourlyVotes counts the votes cast in one hour.
+type HourlyVotes struct {
+	Hour      time.Time `json:"hour"`
+	Upvotes   int       `json:"upvotes"`
+	Downvotes int       `json:"downvotes"`
+	Retracted int       `json:"retracted"` // votes taken back
+}
+
+// ControversialTrack is a track with both up and down votes.
+type ControversialTrack struct {
+	TrackID     string  `json:"track_id"`
+	Upvotes     int     `json:"upvotes"`
+	Downvotes   int     `json:"downvotes"`
+	Controversy float64 `json:"controversy"`
+}
+
+// statsPlaylist returns the playlist of a stats request the caller may see,
+// or writes the error.
+func (app *App) statsPlaylist(w http.ResponseWriter, r *http.Request) (string, bool) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return "", false
+	}
+
+	playlistID := mux.Vars(r)["id"]
+	if voter.IsGuest() && voter.Room.PlaylistID != playlistID {
+		http.Error(w, "Guests can only access their room's playlist", http.StatusForbidden)
+		return "", false
+	}
+	return playlistID, true
+}
+
+// queryInt reads a positive integer query parameter, up to maxValue.
+func queryInt(r *http.Request, name string, defaultValue, maxValue int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 || value > maxValue {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, maxValue)
+	}
+	return value, nil
+}
+
+// handleGetTrackVoteHistory returns a track's total after each vote in the
+// last ?hours (default 24).
+func (app *App) handleGetTrackVoteHistory(w http.ResponseWriter, r *http.Request) {
+	playlistID, ok := app.statsPlaylist(w, r)
+	if !ok {
+		return
+	}
+	trackID := mux.Vars(r)["trackId"]
+
+	hours, err := queryInt(r, "hours", defaultStatsHours, maxStatsHours)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := app.store.VoteEvents(playlistID, trackID, time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		log.Printf("Failed to get vote history: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	points := make([]ScorePoint, len(events))
+	for i, e := range events {
+		points[i] = ScorePoint{Time: e.CreatedAt, Votes: e.Total}
+	}
+
+	current, err := app.store.VoteTotal(trackKey{playlistID, trackID})
+	if err != nil {
+		log.Printf("Failed to get vote total: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"track_id": trackID,
+		"votes":    current,
+		"points":   points,
+	})
+}
+
+// handleGetVotesPerHour counts the playlist's votes in each of the last
+// ?hours (default 24), oldest first. Hours without votes are included.
+func (app *App) handleGetVotesPerHour(w http.ResponseWriter, r *http.Request) {
+	playlistID, ok := app.statsPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	hours, err := queryInt(r, "hours", defaultStatsHours, maxStatsHours)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+	events, err := app.store.VoteEvents(playlistID, "", start)
+	if err != nil {
+		log.Printf("Failed to get vote history: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	buckets := make([]HourlyVotes, hours)
+	for i := range buckets {
+		buckets[i].Hour = start.Add(time.Duration(i) * time.Hour)
+	}
+	for _, e := range events {
+		i := int(e.CreatedAt.Sub(start) / time.Hour)
+		if i < 0 || i >= len(buckets) || strings.HasPrefix(e.userID, votePolicyVoter) {
+			continue
+		}
+		switch {
+		case e.Vote > 0:
+			buckets[i].Upvotes++
+		case e.Vote < 0:
+			buckets[i].Downvotes++
+		default:
+			buckets[i].Retracted++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// handleGetControversialTracks returns the playlist's tracks with the most
+// evenly split votes, up to ?limit (default 10).
+func (app *App) handleGetControversialTracks(w http.ResponseWriter, r *http.Request) {
+	playlistID, ok := app.statsPlaylist(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := queryInt(r, "limit", defaultControversialLimit, maxControversialLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := app.store.VoteCounts(playlistID)
+	if err != nil {
+		log.Printf("Failed to count votes: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tracks := []ControversialTrack{}
+	for trackID, c := range counts {
+		if score := controversy(c.Up, c.Down); score > 0 {
+			tracks = append(tracks, ControversialTrack{TrackID: trackID, Upvotes: c.Up, Downvotes: c.Down, Controversy: score})
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].Controversy != tracks[j].Controversy {
+			return tracks[i].Controversy > tracks[j].Controversy
+		}
+		return tracks[i].TrackID < tracks[j].TrackID
+	})
+	if len(tracks) > limit {
+		tracks = tracks[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracks)
+}
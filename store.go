@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Store persists the data every app instance has to agree on: vote totals,
+// each user's votes, login sessions, removed tracks, rooms and their guests,
+// and roles. It's SQLite by default and Postgres when DATABASE_URL points to
+// one, so several instances can share it.
+//
+// Everything else is still per instance: playlist settings, removal rules,
+// suggestions and reorder schedules live in the local SQLite database
+// (App.db), rate limits and Auto-DJ workers in memory. Instances sharing a
+// Postgres store don't see each other's; see warnPerInstanceData.
+type Store interface {
+	// Vote totals per track. They're read from the store on every request,
+	// instances don't cache them, so votes cast through any instance count.
+	VoteTotals(playlistID string) (map[string]int, error)
+	VoteTotal(key trackKey) (int, error)
+	// AdoptLegacyVotes moves votes and user votes of the given tracks from
+	// legacyPlaylistID to playlistID.
+	AdoptLegacyVotes(playlistID string, trackIDs []string) error
+	// VoteMismatches lists tracks whose total differs from the sum of their
+	// user votes, in the given playlists or, without any, in all of them.
+	VoteMismatches(playlistIDs ...string) ([]VoteMismatch, error)
+	// RepairVotes sets a track's total to the sum of its user votes and
+	// returns it.
+	RepairVotes(key trackKey) (int, error)
+
+	// Each user's current vote on a track
+	UserVote(userID string, key trackKey) (StoredVote, error)
+	// UserVotes returns the user's votes on the playlist's tracks by track
+	// ID, in one query. Tracks without a vote are left out.
+	UserVotes(userID, playlistID string) (map[string]StoredVote, error)
+	// ApplyVote casts the ballot (see castBallot), updates the track's total
+	// and records the vote in vote_events, in one transaction, so concurrent
+	// votes can't be lost, counted twice or overspend the budget. Over budget
+	// it returns errNoUpvotesLeft or errNoSuperlikesLeft.
+	ApplyVote(userID string, key trackKey, ballot Ballot) (VoteResult, error)
+	// VoteUsage counts the user's standing votes in the playlist cast since
+	// the given time.
+	VoteUsage(userID, playlistID string, since time.Time) (VoteUsage, error)
+	// ApplyVotePolicy clears (VotePolicyReset) or halves (VotePolicyDecay)
+	// the votes on a track, recounts its total and records the change in
+	// vote_events, in one transaction, so a vote cast meanwhile isn't lost.
+	// It returns the new total.
+	ApplyVotePolicy(key trackKey, policy string) (int, error)
+	// ActiveVoters counts users who voted in the playlist since the given time.
+	ActiveVoters(playlistID string, since time.Time) (int, error)
+	TrackVoteCounts(key trackKey) (VoteCounts, error)
+	// TrackVoteCountsSince counts the up and down votes on a track cast at
+	// or after since.
+	TrackVoteCountsSince(key trackKey, since time.Time) (VoteCounts, error)
+	// VoteCounts counts the current up and down votes on each track of the
+	// playlist that has any.
+	VoteCounts(playlistID string) (map[string]VoteCounts, error)
+
+	// UserVotesSince returns the up and down votes in the playlist last
+	// changed at or after since, with Vote in points.
+	UserVotesSince(playlistID string, since time.Time) ([]TimedVote, error)
+
+	// VoteEvents returns the playlist's votes since the given time, oldest
+	// first. With a trackID only that track's.
+	VoteEvents(playlistID, trackID string, since time.Time) ([]VoteEvent, error)
+
+	// Login sessions. Tokens are stored as given; callers encrypt them.
+	LoadSessions() ([]StoredSession, error)
+	GetSession(sessionID string) (StoredSession, bool, error)
+	SaveSession(session StoredSession) error
+	UpdateSessionToken(sessionID, accessToken, refreshToken string, expiry time.Time) error
+	// ReplaceSessionTokens rewrites the tokens of several sessions at once,
+	// all or nothing (used to re-encrypt them).
+	ReplaceSessionTokens(sessions []StoredSession) error
+	TouchSession(sessionID string, lastSeen time.Time) error
+	DeleteSessions(sessionIDs ...string) error
+	DeleteUserSessions(userID string) error
+	// DeleteExpiredSessions removes sessions created before createdBefore or
+	// last seen before idleBefore, and returns how many were removed.
+	DeleteExpiredSessions(createdBefore, idleBefore time.Time) (int64, error)
+
+	// Tracks removed from playlists
+	SaveDeletedTrack(track RemovedTrack, votes int, deletedBy string, position *int) error
+	DeletedTracks(playlistID string) ([]DeletedTrack, error)
+	// DeletedTrack returns the track if it was removed and not restored.
+	DeletedTrack(key trackKey) (DeletedTrack, bool, error)
+	MarkTrackRestored(key trackKey, restoredBy string) error
+
+	// Rooms and their guests. Room and HostRoom only find open rooms.
+	CreateRoom(code, playlistID, hostUserID string) error
+	Room(code string) (Room, bool, error)
+	HostRoom(playlistID, hostUserID string) (Room, bool, error)
+	CloseRoom(code string) error
+	AddRoomGuest(guestID, code, nickname string) error
+	// RoomGuest returns the guest's nickname in the room.
+	RoomGuest(guestID, code string) (string, bool, error)
+	RoomGuestCount(code string) (int, error)
+
+	// Roles granted on playlists. The Spotify owner's isn't stored, see
+	// roleFor.
+	PlaylistRole(playlistID, userID string) (string, bool, error)
+	PlaylistRoles(playlistID string) ([]RoleGrant, error)
+	// GrantRole sets the user's role, replacing an earlier grant.
+	GrantRole(playlistID, userID, role, grantedBy string) error
+	// RevokeRole removes the user's grant and reports whether there was one.
+	RevokeRole(playlistID, userID string) (bool, error)
+
+	Close() error
+}
+
+// VoteResult is the outcome of a committed vote.
+type VoteResult struct {
+	Previous StoredVote // the user's vote before
+	Current  StoredVote // the user's vote now
+	Delta    int        // change to the total
+	Total    int        // the track's new total
+	Counts   VoteCounts // the track's up and down votes now
+	Used     VoteUsage  // the user's votes counting against the budget now
+}
+
+// VoteCounts are the up and down votes on a track.
+type VoteCounts struct {
+	Up   int `json:"upvotes"`
+	Down int `json:"downvotes"`
+}
+
+// TimedVote is a user's current vote on a track and when it was cast.
+type TimedVote struct {
+	TrackID string
+	Vote    int
+	VotedAt time.Time
+}
+
+// VoteEvent is one vote in the vote history.
+type VoteEvent struct {
+	TrackID   string    `json:"track_id"`
+	Vote      int       `json:"vote"`  // the user's vote afterwards, 0 if they took it back
+	Delta     int       `json:"delta"` // change to the total
+	Total     int       `json:"total"` // the track's total afterwards
+	CreatedAt time.Time `json:"created_at"`
+
+	userID string // the voter, or votePolicyVoter for a vote policy
+}
+
+// VoteMismatch is a track whose total in the votes table doesn't match its
+// user votes.
+type VoteMismatch struct {
+	PlaylistID string `json:"playlist_id"`
+	TrackID    string `json:"track_id"`
+	Stored     int    `json:"stored"`   // vote_count in votes
+	Expected   int    `json:"expected"` // sum of user_votes
+}
+
+// voteMismatchQuery finds totals that differ from the sum of the user votes,
+// including tracks with user votes but no total. It's written with ?
+// placeholders, one per playlist ID to filter on.
+func voteMismatchQuery(playlists int) string {
+	query := `
+		SELECT playlist_id, track_id, stored, expected FROM (
+			SELECT v.playlist_id, v.track_id, v.vote_count AS stored,
+				COALESCE((SELECT SUM(u.vote * u.weight) FROM user_votes u
+					WHERE u.playlist_id = v.playlist_id AND u.track_id = v.track_id), 0) AS expected
+			FROM votes v
+			UNION ALL
+			SELECT u.playlist_id, u.track_id, 0 AS stored, SUM(u.vote * u.weight) AS expected
+			FROM user_votes u
+			WHERE NOT EXISTS (SELECT 1 FROM votes v
+				WHERE v.playlist_id = u.playlist_id AND v.track_id = u.track_id)
+			GROUP BY u.playlist_id, u.track_id
+		) AS totals
+		WHERE stored <> expected`
+	if playlists > 0 {
+		query += ` AND playlist_id IN (?` + strings.Repeat(", ?", playlists-1) + `)`
+	}
+	return query + ` ORDER BY playlist_id, track_id`
+}
+
+func scanVoteMismatches(rows *sql.Rows) ([]VoteMismatch, error) {
+	defer rows.Close()
+
+	mismatches := []VoteMismatch{}
+	for rows.Next() {
+		var m VoteMismatch
+		if err := rows.Scan(&m.PlaylistID, &m.TrackID, &m.Stored, &m.Expected); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+func scanVoteCounts(rows *sql.Rows) (map[string]VoteCounts, error) {
+	defer rows.Close()
+
+	counts := make(map[string]VoteCounts)
+	for rows.Next() {
+		var trackID string
+		var c VoteCounts
+		if err := rows.Scan(&trackID, &c.Up, &c.Down); err != nil {
+			return nil, err
+		}
+		counts[trackID] = c
+	}
+	return counts, rows.Err()
+}
+
+func scanVoteTotals(rows *sql.Rows) (map[string]int, error) {
+	defer rows.Close()
+
+	totals := make(map[string]int)
+	for rows.Next() {
+		var trackID string
+		var total int
+		if err := rows.Scan(&trackID, &total); err != nil {
+			return nil, err
+		}
+		totals[trackID] = total
+	}
+	return totals, rows.Err()
+}
+
+func scanStoredVotes(rows *sql.Rows) (map[string]StoredVote, error) {
+	defer rows.Close()
+
+	votes := make(map[string]StoredVote)
+	for rows.Next() {
+		var trackID string
+		var v StoredVote
+		if err := rows.Scan(&trackID, &v.Vote, &v.Weight, &v.Superlike); err != nil {
+			return nil, err
+		}
+		votes[trackID] = v
+	}
+	return votes, rows.Err()
+}
+
+func scanTimedVotes(rows *sql.Rows) ([]TimedVote, error) {
+	defer rows.Close()
+
+	votes := []TimedVote{}
+	for rows.Next() {
+		var v TimedVote
+		if err := rows.Scan(&v.TrackID, &v.Vote, &v.VotedAt); err != nil {
+			return nil, err
+		}
+		votes = append(votes, v)
+	}
+	return votes, rows.Err()
+}
+
+func scanVoteEvents(rows *sql.Rows) ([]VoteEvent, error) {
+	defer rows.Close()
+
+	events := []VoteEvent{}
+	for rows.Next() {
+		var e VoteEvent
+		if err := rows.Scan(&e.userID, &e.TrackID, &e.Vote, &e.Delta, &e.Total, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// StoredSession is a row of the sessions table.
+type StoredSession struct {
+	SessionID    string
+	UserID       string
+	AccessToken  string
+	RefreshToken string // empty if Spotify didn't give one
+	TokenExpiry  time.Time
+	CreatedAt    time.Time
+	LastSeen     time.Time
+}
+
+// DeletedTrack is a track that was removed from a playlist.
+type DeletedTrack struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Artists   string    `json:"artists"`
+	Album     string    `json:"album"`
+	ImageURL  string    `json:"image_url"`
+	URI       string    `json:"uri"`
+	Votes     int       `json:"votes"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Position  *int      `json:"position"` // nil if unknown
+}
+
+// openStore picks the store from DATABASE_URL: a postgres:// or
+// postgresql:// URL selects Postgres, anything else uses the SQLite database.
+func openStore(sqliteDB *sql.DB) (Store, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	switch {
+	case dsn == "" || strings.HasPrefix(dsn, "sqlite:"):
+		return &sqliteStore{db: sqliteDB}, nil
+	case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+		return newPostgresStore(dsn)
+	default:
+		return nil, fmt.Errorf("DATABASE_URL must be a postgres:// URL, or empty for SQLite")
+	}
+}
+
+// warnPerInstanceData warns at startup when the store is shared through
+// Postgres but this instance's SQLite database holds data the other instances
+// won't see.
+func warnPerInstanceData(store Store, db *sql.DB) {
+	if _, shared := store.(*postgresStore); !shared {
+		return
+	}
+
+	for _, local := range []struct {
+		table string
+		what  string
+	}{
+		{"playlist_settings", "playlist settings"},
+		{"removal_rules", "removal rules"},
+		{"suggestions", "suggestions"},
+		{"reorder_schedules", "reorder schedules"},
+	} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + local.table).Scan(&n); err != nil {
+			log.Printf("⚠️  Failed to count %s: %v", local.what, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("⚠️  %d %s are stored in this instance's SQLite file; other instances sharing DATABASE_URL don't see them", n, local.what)
+		}
+	}
+	log.Printf("⚠️  Rate limits and Auto-DJ workers are per instance; run one instance if you rely on them")
+}
+
+func scanRoom(row *sql.Row) (Room, bool, error) {
+	var room Room
+	err := row.Scan(&room.Code, &room.PlaylistID, &room.HostUserID, &room.CreatedAt)
+	if err == sql.ErrNoRows {
+		return room, false, nil
+	}
+	return room, err == nil, err
+}
+
+func scanRoleGrants(rows *sql.Rows) ([]RoleGrant, error) {
+	defer rows.Close()
+
+	grants := []RoleGrant{}
+	for rows.Next() {
+		var grant RoleGrant
+		if err := rows.Scan(&grant.UserID, &grant.Role, &grant.GrantedBy, &grant.GrantedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func nullablePosition(position sql.NullInt64) *int {
+	if !position.Valid {
+		return nil
+	}
+	pos := int(position.Int64)
+	return &pos
+}
+
+func nullableString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresSchema holds the Store's tables when they live in Postgres.
+var postgresSchema = schema{
+	name:       "postgres",
+	migrations: postgresMigrations,
+	rebind:     rebindPostgres,
+	lock:       "SELECT pg_advisory_xact_lock(7305401)",
+}
+
+// postgresMigrations is the Postgres schema history. Never change a migration
+// that has shipped; add a new one instead.
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		name:    "votes, sessions, deleted tracks and user votes",
+		up: func(tx sqlExecutor) error {
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS votes (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote_count INTEGER NOT NULL DEFAULT 0,
+					updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					PRIMARY KEY (playlist_id, track_id)
+				)`, `
+				CREATE TABLE IF NOT EXISTS user_votes (
+					user_id TEXT NOT NULL,
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote INTEGER NOT NULL DEFAULT 0,
+					voted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					PRIMARY KEY (user_id, playlist_id, track_id)
+				)`, `
+				CREATE INDEX IF NOT EXISTS user_votes_track ON user_votes (playlist_id, track_id)`, `
+				CREATE TABLE IF NOT EXISTS sessions (
+					session_id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					access_token TEXT NOT NULL,
+					refresh_token TEXT,
+					token_expiry TIMESTAMPTZ NOT NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					last_seen_at TIMESTAMPTZ
+				)`, `
+				CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id)`, `
+				CREATE TABLE IF NOT EXISTS deleted_tracks (
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					track_name TEXT NOT NULL,
+					track_artists TEXT NOT NULL,
+					track_album TEXT NOT NULL,
+					track_image_url TEXT,
+					track_uri TEXT NOT NULL,
+					votes_at_deletion INTEGER NOT NULL DEFAULT 0,
+					deleted_by TEXT NOT NULL,
+					deleted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					track_position INTEGER,
+					restored_at TIMESTAMPTZ,
+					restored_by TEXT,
+					PRIMARY KEY (playlist_id, track_id)
+				)`)
+		},
+		down: dropTables("deleted_tracks", "sessions", "user_votes", "votes"),
+	},
+	{
+		version: 2,
+		name:    "vote history",
+		up: func(tx sqlExecutor) error {
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS vote_events (
+					id BIGSERIAL PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					playlist_id TEXT NOT NULL,
+					track_id TEXT NOT NULL,
+					vote INTEGER NOT NULL,
+					delta INTEGER NOT NULL,
+					total INTEGER NOT NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+				)`, `
+				CREATE INDEX IF NOT EXISTS vote_events_track ON vote_events (playlist_id, track_id, created_at)`, `
+				CREATE INDEX IF NOT EXISTS vote_events_playlist ON vote_events (playlist_id, created_at)`)
+		},
+		down: dropTables("vote_events"),
+	},
+	{
+		version: 3,
+		name:    "vote weights and superlikes",
+		up: func(tx sqlExecutor) error {
+			return execAll(tx, `
+				ALTER TABLE user_votes
+					ADD COLUMN IF NOT EXISTS weight INTEGER NOT NULL DEFAULT 1,
+					ADD COLUMN IF NOT EXISTS superlike BOOLEAN NOT NULL DEFAULT false`)
+		},
+		down: func(tx sqlExecutor) error {
+			return execAll(tx, `ALTER TABLE user_votes DROP COLUMN weight, DROP COLUMN superlike`)
+		},
+	},
+	{
+		version: 4,
+		name:    "rooms and playlist roles",
+		up: func(tx sqlExecutor) error {
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS rooms (
+					code TEXT PRIMARY KEY,
+					playlist_id TEXT NOT NULL,
+					host_user_id TEXT NOT NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					closed_at TIMESTAMPTZ
+				)`, `
+				CREATE INDEX IF NOT EXISTS rooms_host ON rooms (playlist_id, host_user_id)`, `
+				CREATE TABLE IF NOT EXISTS room_guests (
+					guest_id TEXT PRIMARY KEY,
+					room_code TEXT NOT NULL,
+					nickname TEXT NOT NULL,
+					joined_at TIMESTAMPTZ NOT NULL DEFAULT now()
+				)`, `
+				CREATE INDEX IF NOT EXISTS room_guests_room ON room_guests (room_code)`, `
+				CREATE TABLE IF NOT EXISTS playlist_roles (
+					playlist_id TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					role TEXT NOT NULL,
+					granted_by TEXT NOT NULL,
+					granted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+					PRIMARY KEY (playlist_id, user_id)
+				)`)
+		},
+		down: dropTables("playlist_roles", "room_guests", "rooms"),
+	},
+}
+
+// rebindPostgres turns ? placeholders into $1, $2, ...
+func rebindPostgres(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func openPostgres(dsn string) (*sql.DB, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// postgresStore is the Store on a Postgres database shared by all instances.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateUp(db, postgresSchema, postgresSchema.latest()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating postgres: %w", err)
+	}
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) VoteTotals(playlistID string) (map[string]int, error) {
+	rows, err := s.db.Query("SELECT track_id, vote_count FROM votes WHERE playlist_id = $1", playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteTotals(rows)
+}
+
+func (s *postgresStore) VoteTotal(key trackKey) (int, error) {
+	var total int
+	err := s.db.QueryRow("SELECT vote_count FROM votes WHERE playlist_id = $1 AND track_id = $2", key.PlaylistID, key.TrackID).Scan(&total)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return total, err
+}
+
+func (s *postgresStore) VoteMismatches(playlistIDs ...string) ([]VoteMismatch, error) {
+	rows, err := s.db.Query(rebindPostgres(voteMismatchQuery(len(playlistIDs))), stringArgs(playlistIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteMismatches(rows)
+}
+
+func (s *postgresStore) RepairVotes(key trackKey) (int, error) {
+	var total int
+	err := s.db.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		SELECT $1, $2, COALESCE(SUM(vote * weight), 0), now()
+		FROM user_votes WHERE playlist_id = $1 AND track_id = $2
+		ON CONFLICT (playlist_id, track_id)
+		DO UPDATE SET vote_count = EXCLUDED.vote_count, updated_at = now()
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID).Scan(&total)
+	return total, err
+}
+
+func (s *postgresStore) AdoptLegacyVotes(playlistID string, trackIDs []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"votes", "user_votes"} {
+		_, err := tx.Exec(fmt.Sprintf(
+			"UPDATE %s SET playlist_id = $1 WHERE playlist_id = $2 AND track_id = ANY($3)", table),
+			playlistID, legacyPlaylistID, pq.Array(trackIDs))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) UserVote(userID string, key trackKey) (StoredVote, error) {
+	return postgresUserVote(s.db, userID, key, "")
+}
+
+// postgresUserVote reads the user's vote; lock is appended to the query,
+// e.g. FOR UPDATE.
+func postgresUserVote(db sqlExecutor, userID string, key trackKey, lock string) (StoredVote, error) {
+	vote := StoredVote{Weight: 1}
+	err := db.QueryRow(`
+		SELECT vote, weight, superlike FROM user_votes
+		WHERE user_id = $1 AND playlist_id = $2 AND track_id = $3
+	`+lock, userID, key.PlaylistID, key.TrackID).Scan(&vote.Vote, &vote.Weight, &vote.Superlike)
+	if err == sql.ErrNoRows {
+		return vote, nil
+	}
+	return vote, err
+}
+
+func (s *postgresStore) UserVotes(userID, playlistID string) (map[string]StoredVote, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, vote, weight, superlike FROM user_votes
+		WHERE user_id = $1 AND playlist_id = $2 AND vote <> 0
+	`, userID, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredVotes(rows)
+}
+
+func (s *postgresStore) VoteUsage(userID, playlistID string, since time.Time) (VoteUsage, error) {
+	return postgresVoteUsage(s.db, userID, playlistID, since, "")
+}
+
+// postgresVoteUsage counts the user's standing upvotes and superlikes,
+// leaving out exceptTrackID.
+func postgresVoteUsage(db sqlExecutor, userID, playlistID string, since time.Time, exceptTrackID string) (VoteUsage, error) {
+	var used VoteUsage
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE superlike)
+		FROM user_votes
+		WHERE user_id = $1 AND playlist_id = $2 AND vote > 0 AND voted_at >= $3 AND track_id <> $4
+	`, userID, playlistID, since, exceptTrackID).Scan(&used.Upvotes, &used.Superlikes)
+	return used, err
+}
+
+func (s *postgresStore) ApplyVote(userID string, key trackKey, ballot Ballot) (VoteResult, error) {
+	var result VoteResult
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// One vote per user and playlist at a time, so concurrent votes on
+	// different tracks can't overspend the budget
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))", userID, key.PlaylistID); err != nil {
+		return result, err
+	}
+
+	// Make sure the row exists, then lock it until the vote is committed
+	if _, err := tx.Exec(`
+		INSERT INTO user_votes (user_id, playlist_id, track_id, vote)
+		VALUES ($1, $2, $3, 0)
+		ON CONFLICT (user_id, playlist_id, track_id) DO NOTHING
+	`, userID, key.PlaylistID, key.TrackID); err != nil {
+		return result, err
+	}
+	if result.Previous, err = postgresUserVote(tx, userID, key, " FOR UPDATE"); err != nil {
+		return result, err
+	}
+	used, err := postgresVoteUsage(tx, userID, key.PlaylistID, ballot.BudgetSince, key.TrackID)
+	if err != nil {
+		return result, err
+	}
+	if result.Current, err = castBallot(result.Previous, ballot, used); err != nil {
+		return result, err
+	}
+	delta := result.Current.points() - result.Previous.points()
+	result.Delta = delta
+
+	if _, err := tx.Exec(`
+		UPDATE user_votes SET vote = $1, weight = $2, superlike = $3, voted_at = now()
+		WHERE user_id = $4 AND playlist_id = $5 AND track_id = $6
+	`, result.Current.Vote, result.Current.Weight, result.Current.Superlike,
+		userID, key.PlaylistID, key.TrackID); err != nil {
+		return result, err
+	}
+	if err := tx.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (playlist_id, track_id)
+		DO UPDATE SET vote_count = votes.vote_count + EXCLUDED.vote_count, updated_at = now()
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID, delta).Scan(&result.Total); err != nil {
+		return result, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO vote_events (user_id, playlist_id, track_id, vote, delta, total)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, userID, key.PlaylistID, key.TrackID, result.Current.Vote, delta, result.Total); err != nil {
+		return result, err
+	}
+	if result.Counts, err = postgresTrackVoteCounts(tx, key); err != nil {
+		return result, err
+	}
+	if result.Used, err = postgresVoteUsage(tx, userID, key.PlaylistID, ballot.BudgetSince, ""); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+func (s *postgresStore) ApplyVotePolicy(key trackKey, policy string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	switch policy {
+	case VotePolicyReset:
+		_, err = tx.Exec(`
+			DELETE FROM user_votes WHERE playlist_id = $1 AND track_id = $2
+		`, key.PlaylistID, key.TrackID)
+	case VotePolicyDecay:
+		_, err = tx.Exec(`
+			DELETE FROM user_votes WHERE (user_id, playlist_id, track_id) IN (
+				SELECT user_id, playlist_id, track_id FROM user_votes
+				WHERE playlist_id = $1 AND track_id = $2 AND vote != 0
+				ORDER BY voted_at ASC
+				LIMIT (
+					SELECT (COUNT(*) + 1) / 2 FROM user_votes
+					WHERE playlist_id = $1 AND track_id = $2 AND vote != 0
+				)
+			)
+		`, key.PlaylistID, key.TrackID)
+	default:
+		return 0, fmt.Errorf("unknown vote policy %q", policy)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Locking the total waits for votes that already counted in it; votes
+	// that count later add to the recount below
+	var previous, total int
+	err = tx.QueryRow(`
+		SELECT vote_count FROM votes WHERE playlist_id = $1 AND track_id = $2 FOR UPDATE
+	`, key.PlaylistID, key.TrackID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err := tx.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		SELECT $1, $2, COALESCE(SUM(vote * weight), 0), now()
+		FROM user_votes WHERE playlist_id = $1 AND track_id = $2
+		ON CONFLICT (playlist_id, track_id)
+		DO UPDATE SET vote_count = EXCLUDED.vote_count, updated_at = now()
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID).Scan(&total); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO vote_events (user_id, playlist_id, track_id, vote, delta, total)
+		VALUES ($1, $2, $3, 0, $4, $5)
+	`, votePolicyVoter+policy, key.PlaylistID, key.TrackID, total-previous, total); err != nil {
+		return 0, err
+	}
+
+	return total, tx.Commit()
+}
+
+func (s *postgresStore) ActiveVoters(playlistID string, since time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(DISTINCT user_id) FROM user_votes
+		WHERE playlist_id = $1 AND vote != 0 AND voted_at >= $2
+	`, playlistID, since).Scan(&count)
+	return count, err
+}
+
+func (s *postgresStore) VoteCounts(playlistID string) (map[string]VoteCounts, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, COUNT(*) FILTER (WHERE vote > 0), COUNT(*) FILTER (WHERE vote < 0)
+		FROM user_votes
+		WHERE playlist_id = $1 AND vote <> 0
+		GROUP BY track_id
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteCounts(rows)
+}
+
+func (s *postgresStore) UserVotesSince(playlistID string, since time.Time) ([]TimedVote, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, vote * weight, voted_at FROM user_votes
+		WHERE playlist_id = $1 AND vote <> 0 AND voted_at >= $2
+	`, playlistID, since)
+	if err != nil {
+		return nil, err
+	}
+	return scanTimedVotes(rows)
+}
+
+func (s *postgresStore) VoteEvents(playlistID, trackID string, since time.Time) ([]VoteEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, track_id, vote, delta, total, created_at FROM vote_events
+		WHERE playlist_id = $1 AND ($2 = '' OR track_id = $2) AND created_at >= $3
+		ORDER BY created_at, id
+	`, playlistID, trackID, since)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteEvents(rows)
+}
+
+func (s *postgresStore) TrackVoteCounts(key trackKey) (VoteCounts, error) {
+	return postgresTrackVoteCounts(s.db, key)
+}
+
+func (s *postgresStore) TrackVoteCountsSince(key trackKey, since time.Time) (VoteCounts, error) {
+	var c VoteCounts
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE vote > 0), COUNT(*) FILTER (WHERE vote < 0)
+		FROM user_votes
+		WHERE playlist_id = $1 AND track_id = $2 AND voted_at >= $3
+	`, key.PlaylistID, key.TrackID, since).Scan(&c.Up, &c.Down)
+	return c, err
+}
+
+func postgresTrackVoteCounts(db sqlExecutor, key trackKey) (VoteCounts, error) {
+	var c VoteCounts
+	err := db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE vote > 0), COUNT(*) FILTER (WHERE vote < 0)
+		FROM user_votes
+		WHERE playlist_id = $1 AND track_id = $2
+	`, key.PlaylistID, key.TrackID).Scan(&c.Up, &c.Down)
+	return c, err
+}
+
+const postgresSessionColumns = `
+	session_id, user_id, access_token, COALESCE(refresh_token, ''), token_expiry,
+	created_at, COALESCE(last_seen_at, updated_at)`
+
+func scanPostgresSession(row interface{ Scan(...interface{}) error }) (StoredSession, error) {
+	var session StoredSession
+	err := row.Scan(&session.SessionID, &session.UserID, &session.AccessToken, &session.RefreshToken,
+		&session.TokenExpiry, &session.CreatedAt, &session.LastSeen)
+	return session, err
+}
+
+func (s *postgresStore) LoadSessions() ([]StoredSession, error) {
+	rows, err := s.db.Query("SELECT " + postgresSessionColumns + " FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []StoredSession{}
+	for rows.Next() {
+		session, err := scanPostgresSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *postgresStore) GetSession(sessionID string) (StoredSession, bool, error) {
+	session, err := scanPostgresSession(s.db.QueryRow(
+		"SELECT "+postgresSessionColumns+" FROM sessions WHERE session_id = $1", sessionID))
+	if err == sql.ErrNoRows {
+		return session, false, nil
+	}
+	return session, err == nil, err
+}
+
+func (s *postgresStore) SaveSession(session StoredSession) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (session_id, user_id, access_token, refresh_token, token_expiry, updated_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, now(), $6)
+		ON CONFLICT (session_id)
+		DO UPDATE SET
+			access_token = EXCLUDED.access_token,
+			refresh_token = EXCLUDED.refresh_token,
+			token_expiry = EXCLUDED.token_expiry,
+			updated_at = now()
+	`, session.SessionID, session.UserID, session.AccessToken, nullableString(session.RefreshToken),
+		session.TokenExpiry, session.LastSeen)
+	return err
+}
+
+func (s *postgresStore) UpdateSessionToken(sessionID, accessToken, refreshToken string, expiry time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions
+		SET access_token = $1, refresh_token = $2, token_expiry = $3, updated_at = now()
+		WHERE session_id = $4
+	`, accessToken, nullableString(refreshToken), expiry, sessionID)
+	return err
+}
+
+func (s *postgresStore) ReplaceSessionTokens(sessions []StoredSession) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, session := range sessions {
+		if _, err := tx.Exec(`
+			UPDATE sessions SET access_token = $1, refresh_token = $2 WHERE session_id = $3
+		`, session.AccessToken, nullableString(session.RefreshToken), session.SessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) TouchSession(sessionID string, lastSeen time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET last_seen_at = $1 WHERE session_id = $2
+	`, lastSeen, sessionID)
+	return err
+}
+
+func (s *postgresStore) DeleteSessions(sessionIDs ...string) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	_, err := s.db.Exec("DELETE FROM sessions WHERE session_id = ANY($1)", pq.Array(sessionIDs))
+	return err
+}
+
+func (s *postgresStore) DeleteUserSessions(userID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	return err
+}
+
+func (s *postgresStore) DeleteExpiredSessions(createdBefore, idleBefore time.Time) (int64, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM sessions
+		WHERE created_at < $1
+		   OR COALESCE(last_seen_at, updated_at) < $2
+	`, createdBefore, idleBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *postgresStore) SaveDeletedTrack(track RemovedTrack, votes int, deletedBy string, position *int) error {
+	_, err := s.db.Exec(`
+		INSERT INTO deleted_tracks
+		(track_id, playlist_id, track_name, track_artists, track_album, track_image_url, track_uri, votes_at_deletion, deleted_by, track_position)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (playlist_id, track_id) DO UPDATE SET
+			votes_at_deletion = EXCLUDED.votes_at_deletion,
+			deleted_by = EXCLUDED.deleted_by,
+			track_position = EXCLUDED.track_position,
+			deleted_at = now(),
+			restored_at = NULL,
+			restored_by = NULL
+	`, track.TrackID, track.PlaylistID, track.Name, track.Artists, track.Album, track.ImageURL,
+		track.URI, votes, deletedBy, position)
+	return err
+}
+
+func (s *postgresStore) DeletedTracks(playlistID string) ([]DeletedTrack, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, track_name, track_artists, track_album, COALESCE(track_image_url, ''),
+		       track_uri, votes_at_deletion, deleted_by, deleted_at, track_position
+		FROM deleted_tracks
+		WHERE playlist_id = $1 AND restored_at IS NULL
+		ORDER BY deleted_at DESC
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []DeletedTrack{}
+	for rows.Next() {
+		var track DeletedTrack
+		var position sql.NullInt64
+		if err := rows.Scan(&track.ID, &track.Name, &track.Artists, &track.Album,
+			&track.ImageURL, &track.URI, &track.Votes, &track.DeletedBy, &track.DeletedAt, &position); err != nil {
+			return nil, err
+		}
+		track.Position = nullablePosition(position)
+		tracks = append(tracks, track)
+	}
+	return tracks, rows.Err()
+}
+
+func (s *postgresStore) DeletedTrack(key trackKey) (DeletedTrack, bool, error) {
+	track := DeletedTrack{ID: key.TrackID}
+	var position sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT track_uri, votes_at_deletion, track_position
+		FROM deleted_tracks
+		WHERE playlist_id = $1 AND track_id = $2 AND restored_at IS NULL
+	`, key.PlaylistID, key.TrackID).Scan(&track.URI, &track.Votes, &position)
+	if err == sql.ErrNoRows {
+		return track, false, nil
+	}
+	if err != nil {
+		return track, false, err
+	}
+	track.Position = nullablePosition(position)
+	return track, true, nil
+}
+
+func (s *postgresStore) MarkTrackRestored(key trackKey, restoredBy string) error {
+	_, err := s.db.Exec(`
+		UPDATE deleted_tracks
+		SET restored_at = now(), restored_by = $1
+		WHERE playlist_id = $2 AND track_id = $3
+	`, restoredBy, key.PlaylistID, key.TrackID)
+	return err
+}
+
+func (s *postgresStore) CreateRoom(code, playlistID, hostUserID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO rooms (code, playlist_id, host_user_id)
+		VALUES ($1, $2, $3)
+	`, code, playlistID, hostUserID)
+	return err
+}
+
+func (s *postgresStore) Room(code string) (Room, bool, error) {
+	return scanRoom(s.db.QueryRow(`
+		SELECT code, playlist_id, host_user_id, created_at
+		FROM rooms
+		WHERE code = $1 AND closed_at IS NULL
+	`, code))
+}
+
+func (s *postgresStore) HostRoom(playlistID, hostUserID string) (Room, bool, error) {
+	return scanRoom(s.db.QueryRow(`
+		SELECT code, playlist_id, host_user_id, created_at
+		FROM rooms
+		WHERE playlist_id = $1 AND host_user_id = $2 AND closed_at IS NULL
+	`, playlistID, hostUserID))
+}
+
+func (s *postgresStore) CloseRoom(code string) error {
+	_, err := s.db.Exec("UPDATE rooms SET closed_at = now() WHERE code = $1", code)
+	return err
+}
+
+func (s *postgresStore) AddRoomGuest(guestID, code, nickname string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO room_guests (guest_id, room_code, nickname)
+		VALUES ($1, $2, $3)
+	`, guestID, code, nickname)
+	return err
+}
+
+func (s *postgresStore) RoomGuest(guestID, code string) (string, bool, error) {
+	var nickname string
+	err := s.db.QueryRow(`
+		SELECT nickname FROM room_guests
+		WHERE guest_id = $1 AND room_code = $2
+	`, guestID, code).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return nickname, err == nil, err
+}
+
+func (s *postgresStore) RoomGuestCount(code string) (int, error) {
+	var guests int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM room_guests WHERE room_code = $1", code).Scan(&guests)
+	return guests, err
+}
+
+func (s *postgresStore) PlaylistRole(playlistID, userID string) (string, bool, error) {
+	var role string
+	err := s.db.QueryRow(`
+		SELECT role FROM playlist_roles WHERE playlist_id = $1 AND user_id = $2
+	`, playlistID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return role, err == nil, err
+}
+
+func (s *postgresStore) PlaylistRoles(playlistID string) ([]RoleGrant, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, role, granted_by, granted_at
+		FROM playlist_roles
+		WHERE playlist_id = $1
+		ORDER BY granted_at
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoleGrants(rows)
+}
+
+func (s *postgresStore) GrantRole(playlistID, userID, role, grantedBy string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO playlist_roles (playlist_id, user_id, role, granted_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (playlist_id, user_id)
+		DO UPDATE SET role = EXCLUDED.role, granted_by = EXCLUDED.granted_by, granted_at = now()
+	`, playlistID, userID, role, grantedBy)
+	return err
+}
+
+func (s *postgresStore) RevokeRole(playlistID, userID string) (bool, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM playlist_roles WHERE playlist_id = $1 AND user_id = $2
+	`, playlistID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRebindPostgres(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM votes WHERE playlist_id = ?", "SELECT * FROM votes WHERE playlist_id = $1"},
+		{
+			"INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		},
+		{"? ? ? ? ? ? ? ? ? ? ?", "$1 $2 $3 $4 $5 $6 $7 $8 $9 $10 $11"},
+		{"WHERE name = 'café' AND id = ?", "WHERE name = 'café' AND id = $1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := rebindPostgres(tt.query); got != tt.want {
+				t.Errorf("rebindPostgres(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebindVoteMismatchQuery(t *testing.T) {
+	for _, playlists := range []int{0, 1, 3} {
+		query := rebindPostgres(voteMismatchQuery(playlists))
+		if strings.Contains(query, "?") {
+			t.Errorf("voteMismatchQuery(%d) still has ? placeholders: %s", playlists, query)
+		}
+		if playlists > 0 && !strings.Contains(query, fmt.Sprintf("$%d", playlists)) {
+			t.Errorf("voteMismatchQuery(%d) is missing $%d: %s", playlists, playlists, query)
+		}
+	}
+}
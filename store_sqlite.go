@@ -0,0 +1,621 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteStore is the Store on the app's SQLite database. Its tables are
+// created by the migrations in migrations.go.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteTime formats t like CURRENT_TIMESTAMP does, so the two compare as text.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (s *sqliteStore) VoteTotals(playlistID string) (map[string]int, error) {
+	rows, err := s.db.Query("SELECT track_id, vote_count FROM votes WHERE playlist_id = ?", playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteTotals(rows)
+}
+
+func (s *sqliteStore) VoteTotal(key trackKey) (int, error) {
+	var total int
+	err := s.db.QueryRow("SELECT vote_count FROM votes WHERE playlist_id = ? AND track_id = ?", key.PlaylistID, key.TrackID).Scan(&total)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return total, err
+}
+
+func (s *sqliteStore) VoteMismatches(playlistIDs ...string) ([]VoteMismatch, error) {
+	rows, err := s.db.Query(voteMismatchQuery(len(playlistIDs)), stringArgs(playlistIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteMismatches(rows)
+}
+
+func (s *sqliteStore) RepairVotes(key trackKey) (int, error) {
+	// Recomputed in the same statement, so a vote cast since the check counts
+	var total int
+	err := s.db.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		SELECT ?, ?, COALESCE(SUM(vote * weight), 0), CURRENT_TIMESTAMP
+		FROM user_votes WHERE playlist_id = ? AND track_id = ?
+		ON CONFLICT(playlist_id, track_id)
+		DO UPDATE SET vote_count = excluded.vote_count, updated_at = CURRENT_TIMESTAMP
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID, key.PlaylistID, key.TrackID).Scan(&total)
+	return total, err
+}
+
+func (s *sqliteStore) AdoptLegacyVotes(playlistID string, trackIDs []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, trackID := range trackIDs {
+		for _, table := range []string{"votes", "user_votes"} {
+			_, err := tx.Exec(fmt.Sprintf(
+				"UPDATE %s SET playlist_id = ? WHERE playlist_id = ? AND track_id = ?", table),
+				playlistID, legacyPlaylistID, trackID)
+			if err != nil {
+				return fmt.Errorf("track %s: %w", trackID, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) UserVote(userID string, key trackKey) (StoredVote, error) {
+	return sqliteUserVote(s.db, userID, key)
+}
+
+func sqliteUserVote(db sqlExecutor, userID string, key trackKey) (StoredVote, error) {
+	vote := StoredVote{Weight: 1}
+	err := db.QueryRow(`
+		SELECT vote, weight, superlike FROM user_votes
+		WHERE user_id = ? AND playlist_id = ? AND track_id = ?
+	`, userID, key.PlaylistID, key.TrackID).Scan(&vote.Vote, &vote.Weight, &vote.Superlike)
+	if err == sql.ErrNoRows {
+		return vote, nil
+	}
+	return vote, err
+}
+
+func (s *sqliteStore) UserVotes(userID, playlistID string) (map[string]StoredVote, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, vote, weight, superlike FROM user_votes
+		WHERE user_id = ? AND playlist_id = ? AND vote != 0
+	`, userID, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStoredVotes(rows)
+}
+
+func (s *sqliteStore) VoteUsage(userID, playlistID string, since time.Time) (VoteUsage, error) {
+	return sqliteVoteUsage(s.db, userID, playlistID, since, "")
+}
+
+// sqliteVoteUsage counts the user's standing upvotes and superlikes, leaving
+// out exceptTrackID.
+func sqliteVoteUsage(db sqlExecutor, userID, playlistID string, since time.Time, exceptTrackID string) (VoteUsage, error) {
+	var used VoteUsage
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN superlike THEN 1 ELSE 0 END), 0)
+		FROM user_votes
+		WHERE user_id = ? AND playlist_id = ? AND vote > 0 AND voted_at >= ? AND track_id != ?
+	`, userID, playlistID, sqliteTime(since), exceptTrackID).Scan(&used.Upvotes, &used.Superlikes)
+	return used, err
+}
+
+func (s *sqliteStore) ApplyVote(userID string, key trackKey, ballot Ballot) (VoteResult, error) {
+	var result VoteResult
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// Writing first takes SQLite's write lock, so no other vote can run
+	// between reading the user's vote and updating it
+	if _, err := tx.Exec(`
+		INSERT INTO user_votes (user_id, playlist_id, track_id, vote)
+		VALUES (?, ?, ?, 0)
+		ON CONFLICT(user_id, playlist_id, track_id) DO NOTHING
+	`, userID, key.PlaylistID, key.TrackID); err != nil {
+		return result, err
+	}
+	if result.Previous, err = sqliteUserVote(tx, userID, key); err != nil {
+		return result, err
+	}
+	used, err := sqliteVoteUsage(tx, userID, key.PlaylistID, ballot.BudgetSince, key.TrackID)
+	if err != nil {
+		return result, err
+	}
+	if result.Current, err = castBallot(result.Previous, ballot, used); err != nil {
+		return result, err
+	}
+	delta := result.Current.points() - result.Previous.points()
+	result.Delta = delta
+
+	if _, err := tx.Exec(`
+		UPDATE user_votes SET vote = ?, weight = ?, superlike = ?, voted_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND playlist_id = ? AND track_id = ?
+	`, result.Current.Vote, result.Current.Weight, result.Current.Superlike,
+		userID, key.PlaylistID, key.TrackID); err != nil {
+		return result, err
+	}
+	if err := tx.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(playlist_id, track_id)
+		DO UPDATE SET vote_count = vote_count + excluded.vote_count, updated_at = CURRENT_TIMESTAMP
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID, delta).Scan(&result.Total); err != nil {
+		return result, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO vote_events (user_id, playlist_id, track_id, vote, delta, total)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, key.PlaylistID, key.TrackID, result.Current.Vote, delta, result.Total); err != nil {
+		return result, err
+	}
+	if result.Counts, err = sqliteTrackVoteCounts(tx, key); err != nil {
+		return result, err
+	}
+	if result.Used, err = sqliteVoteUsage(tx, userID, key.PlaylistID, ballot.BudgetSince, ""); err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+func (s *sqliteStore) ApplyVotePolicy(key trackKey, policy string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Deleting first takes SQLite's write lock, so no vote can run between
+	// the delete and the recount
+	switch policy {
+	case VotePolicyReset:
+		_, err = tx.Exec(`
+			DELETE FROM user_votes WHERE playlist_id = ? AND track_id = ?
+		`, key.PlaylistID, key.TrackID)
+	case VotePolicyDecay:
+		_, err = tx.Exec(`
+			DELETE FROM user_votes WHERE rowid IN (
+				SELECT rowid FROM user_votes
+				WHERE playlist_id = ? AND track_id = ? AND vote != 0
+				ORDER BY voted_at ASC
+				LIMIT (
+					SELECT (COUNT(*) + 1) / 2 FROM user_votes
+					WHERE playlist_id = ? AND track_id = ? AND vote != 0
+				)
+			)
+		`, key.PlaylistID, key.TrackID, key.PlaylistID, key.TrackID)
+	default:
+		return 0, fmt.Errorf("unknown vote policy %q", policy)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var previous, total int
+	if err := tx.QueryRow(`
+		SELECT COALESCE((SELECT vote_count FROM votes WHERE playlist_id = ? AND track_id = ?), 0)
+	`, key.PlaylistID, key.TrackID).Scan(&previous); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(`
+		INSERT INTO votes (playlist_id, track_id, vote_count, updated_at)
+		SELECT ?, ?, COALESCE(SUM(vote * weight), 0), CURRENT_TIMESTAMP
+		FROM user_votes WHERE playlist_id = ? AND track_id = ?
+		ON CONFLICT(playlist_id, track_id)
+		DO UPDATE SET vote_count = excluded.vote_count, updated_at = CURRENT_TIMESTAMP
+		RETURNING vote_count
+	`, key.PlaylistID, key.TrackID, key.PlaylistID, key.TrackID).Scan(&total); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO vote_events (user_id, playlist_id, track_id, vote, delta, total)
+		VALUES (?, ?, ?, 0, ?, ?)
+	`, votePolicyVoter+policy, key.PlaylistID, key.TrackID, total-previous, total); err != nil {
+		return 0, err
+	}
+
+	return total, tx.Commit()
+}
+
+func (s *sqliteStore) ActiveVoters(playlistID string, since time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(DISTINCT user_id) FROM user_votes
+		WHERE playlist_id = ? AND vote != 0 AND voted_at >= ?
+	`, playlistID, sqliteTime(since)).Scan(&count)
+	return count, err
+}
+
+func (s *sqliteStore) VoteCounts(playlistID string) (map[string]VoteCounts, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, SUM(CASE WHEN vote > 0 THEN 1 ELSE 0 END), SUM(CASE WHEN vote < 0 THEN 1 ELSE 0 END)
+		FROM user_votes
+		WHERE playlist_id = ? AND vote != 0
+		GROUP BY track_id
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteCounts(rows)
+}
+
+func (s *sqliteStore) UserVotesSince(playlistID string, since time.Time) ([]TimedVote, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, vote * weight, voted_at FROM user_votes
+		WHERE playlist_id = ? AND vote != 0 AND voted_at >= ?
+	`, playlistID, sqliteTime(since))
+	if err != nil {
+		return nil, err
+	}
+	return scanTimedVotes(rows)
+}
+
+func (s *sqliteStore) VoteEvents(playlistID, trackID string, since time.Time) ([]VoteEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, track_id, vote, delta, total, created_at FROM vote_events
+		WHERE playlist_id = ? AND (? = '' OR track_id = ?) AND created_at >= ?
+		ORDER BY created_at, id
+	`, playlistID, trackID, trackID, sqliteTime(since))
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteEvents(rows)
+}
+
+func (s *sqliteStore) TrackVoteCounts(key trackKey) (VoteCounts, error) {
+	return sqliteTrackVoteCounts(s.db, key)
+}
+
+func (s *sqliteStore) TrackVoteCountsSince(key trackKey, since time.Time) (VoteCounts, error) {
+	var c VoteCounts
+	err := s.db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN vote > 0 THEN 1 ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN vote < 0 THEN 1 ELSE 0 END), 0)
+		FROM user_votes
+		WHERE playlist_id = ? AND track_id = ? AND voted_at >= ?
+	`, key.PlaylistID, key.TrackID, sqliteTime(since)).Scan(&c.Up, &c.Down)
+	return c, err
+}
+
+func sqliteTrackVoteCounts(db sqlExecutor, key trackKey) (VoteCounts, error) {
+	var c VoteCounts
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN vote > 0 THEN 1 ELSE 0 END), 0),
+		       COALESCE(SUM(CASE WHEN vote < 0 THEN 1 ELSE 0 END), 0)
+		FROM user_votes
+		WHERE playlist_id = ? AND track_id = ?
+	`, key.PlaylistID, key.TrackID).Scan(&c.Up, &c.Down)
+	return c, err
+}
+
+const sqliteSessionColumns = `
+	session_id, user_id, access_token, refresh_token, token_expiry,
+	created_at, updated_at, last_seen_at`
+
+func scanSQLiteSession(row interface{ Scan(...interface{}) error }) (StoredSession, error) {
+	var session StoredSession
+	var refreshToken sql.NullString
+	var createdAt, updatedAt, lastSeenAt sql.NullTime
+	if err := row.Scan(&session.SessionID, &session.UserID, &session.AccessToken, &refreshToken,
+		&session.TokenExpiry, &createdAt, &updatedAt, &lastSeenAt); err != nil {
+		return session, err
+	}
+	session.RefreshToken = refreshToken.String
+	session.CreatedAt = createdAt.Time
+
+	// Sessions saved before last_seen_at existed were last seen when last updated
+	session.LastSeen = lastSeenAt.Time
+	if !lastSeenAt.Valid {
+		session.LastSeen = updatedAt.Time
+	}
+	return session, nil
+}
+
+func (s *sqliteStore) LoadSessions() ([]StoredSession, error) {
+	rows, err := s.db.Query("SELECT " + sqliteSessionColumns + " FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []StoredSession{}
+	for rows.Next() {
+		session, err := scanSQLiteSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqliteStore) GetSession(sessionID string) (StoredSession, bool, error) {
+	session, err := scanSQLiteSession(s.db.QueryRow(
+		"SELECT "+sqliteSessionColumns+" FROM sessions WHERE session_id = ?", sessionID))
+	if err == sql.ErrNoRows {
+		return session, false, nil
+	}
+	return session, err == nil, err
+}
+
+func (s *sqliteStore) SaveSession(session StoredSession) error {
+	refreshToken := nullableString(session.RefreshToken)
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (session_id, user_id, access_token, refresh_token, token_expiry, updated_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+		ON CONFLICT(session_id)
+		DO UPDATE SET
+			access_token = ?,
+			refresh_token = ?,
+			token_expiry = ?,
+			updated_at = CURRENT_TIMESTAMP
+	`, session.SessionID, session.UserID, session.AccessToken, refreshToken, session.TokenExpiry, session.LastSeen.UTC(),
+		session.AccessToken, refreshToken, session.TokenExpiry)
+	return err
+}
+
+func (s *sqliteStore) UpdateSessionToken(sessionID, accessToken, refreshToken string, expiry time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions
+		SET access_token = ?, refresh_token = ?, token_expiry = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE session_id = ?
+	`, accessToken, nullableString(refreshToken), expiry, sessionID)
+	return err
+}
+
+func (s *sqliteStore) ReplaceSessionTokens(sessions []StoredSession) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, session := range sessions {
+		if _, err := tx.Exec(`
+			UPDATE sessions SET access_token = ?, refresh_token = ? WHERE session_id = ?
+		`, session.AccessToken, nullableString(session.RefreshToken), session.SessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) TouchSession(sessionID string, lastSeen time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions SET last_seen_at = ? WHERE session_id = ?
+	`, lastSeen.UTC(), sessionID)
+	return err
+}
+
+func (s *sqliteStore) DeleteSessions(sessionIDs ...string) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(sessionIDs))
+	for i, id := range sessionIDs {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(sessionIDs)), ",")
+	_, err := s.db.Exec("DELETE FROM sessions WHERE session_id IN ("+placeholders+")", args...)
+	return err
+}
+
+func (s *sqliteStore) DeleteUserSessions(userID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+func (s *sqliteStore) DeleteExpiredSessions(createdBefore, idleBefore time.Time) (int64, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM sessions
+		WHERE created_at < ?
+		   OR COALESCE(last_seen_at, updated_at, created_at) < ?
+	`, sqliteTime(createdBefore), sqliteTime(idleBefore))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqliteStore) SaveDeletedTrack(track RemovedTrack, votes int, deletedBy string, position *int) error {
+	_, err := s.db.Exec(`
+		INSERT INTO deleted_tracks
+		(track_id, playlist_id, track_name, track_artists, track_album, track_image_url, track_uri, votes_at_deletion, deleted_by, track_position)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(playlist_id, track_id) DO UPDATE SET
+			votes_at_deletion = ?,
+			deleted_by = ?,
+			track_position = ?,
+			deleted_at = CURRENT_TIMESTAMP,
+			restored_at = NULL,
+			restored_by = NULL
+	`, track.TrackID, track.PlaylistID, track.Name, track.Artists, track.Album, track.ImageURL,
+		track.URI, votes, deletedBy, position, votes, deletedBy, position)
+	return err
+}
+
+func (s *sqliteStore) DeletedTracks(playlistID string) ([]DeletedTrack, error) {
+	rows, err := s.db.Query(`
+		SELECT track_id, track_name, track_artists, track_album, track_image_url,
+		       track_uri, votes_at_deletion, deleted_by, deleted_at, track_position
+		FROM deleted_tracks
+		WHERE playlist_id = ? AND restored_at IS NULL
+		ORDER BY deleted_at DESC
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []DeletedTrack{}
+	for rows.Next() {
+		var track DeletedTrack
+		var imageURL sql.NullString
+		var position sql.NullInt64
+		if err := rows.Scan(&track.ID, &track.Name, &track.Artists, &track.Album,
+			&imageURL, &track.URI, &track.Votes, &track.DeletedBy, &track.DeletedAt, &position); err != nil {
+			return nil, err
+		}
+		track.ImageURL = imageURL.String
+		track.Position = nullablePosition(position)
+		tracks = append(tracks, track)
+	}
+	return tracks, rows.Err()
+}
+
+func (s *sqliteStore) DeletedTrack(key trackKey) (DeletedTrack, bool, error) {
+	track := DeletedTrack{ID: key.TrackID}
+	var position sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT track_uri, votes_at_deletion, track_position
+		FROM deleted_tracks
+		WHERE playlist_id = ? AND track_id = ? AND restored_at IS NULL
+	`, key.PlaylistID, key.TrackID).Scan(&track.URI, &track.Votes, &position)
+	if err == sql.ErrNoRows {
+		return track, false, nil
+	}
+	if err != nil {
+		return track, false, err
+	}
+	track.Position = nullablePosition(position)
+	return track, true, nil
+}
+
+func (s *sqliteStore) MarkTrackRestored(key trackKey, restoredBy string) error {
+	_, err := s.db.Exec(`
+		UPDATE deleted_tracks
+		SET restored_at = CURRENT_TIMESTAMP, restored_by = ?
+		WHERE playlist_id = ? AND track_id = ?
+	`, restoredBy, key.PlaylistID, key.TrackID)
+	return err
+}
+
+func (s *sqliteStore) CreateRoom(code, playlistID, hostUserID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO rooms (code, playlist_id, host_user_id)
+		VALUES (?, ?, ?)
+	`, code, playlistID, hostUserID)
+	return err
+}
+
+func (s *sqliteStore) Room(code string) (Room, bool, error) {
+	return scanRoom(s.db.QueryRow(`
+		SELECT code, playlist_id, host_user_id, created_at
+		FROM rooms
+		WHERE code = ? AND closed_at IS NULL
+	`, code))
+}
+
+func (s *sqliteStore) HostRoom(playlistID, hostUserID string) (Room, bool, error) {
+	return scanRoom(s.db.QueryRow(`
+		SELECT code, playlist_id, host_user_id, created_at
+		FROM rooms
+		WHERE playlist_id = ? AND host_user_id = ? AND closed_at IS NULL
+	`, playlistID, hostUserID))
+}
+
+func (s *sqliteStore) CloseRoom(code string) error {
+	_, err := s.db.Exec("UPDATE rooms SET closed_at = CURRENT_TIMESTAMP WHERE code = ?", code)
+	return err
+}
+
+func (s *sqliteStore) AddRoomGuest(guestID, code, nickname string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO room_guests (guest_id, room_code, nickname)
+		VALUES (?, ?, ?)
+	`, guestID, code, nickname)
+	return err
+}
+
+func (s *sqliteStore) RoomGuest(guestID, code string) (string, bool, error) {
+	var nickname string
+	err := s.db.QueryRow(`
+		SELECT nickname FROM room_guests
+		WHERE guest_id = ? AND room_code = ?
+	`, guestID, code).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return nickname, err == nil, err
+}
+
+func (s *sqliteStore) RoomGuestCount(code string) (int, error) {
+	var guests int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM room_guests WHERE room_code = ?", code).Scan(&guests)
+	return guests, err
+}
+
+func (s *sqliteStore) PlaylistRole(playlistID, userID string) (string, bool, error) {
+	var role string
+	err := s.db.QueryRow(`
+		SELECT role FROM playlist_roles WHERE playlist_id = ? AND user_id = ?
+	`, playlistID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return role, err == nil, err
+}
+
+func (s *sqliteStore) PlaylistRoles(playlistID string) ([]RoleGrant, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, role, granted_by, granted_at
+		FROM playlist_roles
+		WHERE playlist_id = ?
+		ORDER BY granted_at
+	`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRoleGrants(rows)
+}
+
+func (s *sqliteStore) GrantRole(playlistID, userID, role, grantedBy string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO playlist_roles (playlist_id, user_id, role, granted_by)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(playlist_id, user_id)
+		DO UPDATE SET role = excluded.role, granted_by = excluded.granted_by, granted_at = CURRENT_TIMESTAMP
+	`, playlistID, userID, role, grantedBy)
+	return err
+}
+
+func (s *sqliteStore) RevokeRole(playlistID, userID string) (bool, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM playlist_roles WHERE playlist_id = ? AND user_id = ?
+	`, playlistID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Close is a no-op: the database is App.db, which outlives the store.
+func (s *sqliteStore) Close() error {
+	return nil
+}
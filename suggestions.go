@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	SuggestionPending = "pending"
+	SuggestionAdded   = "added"
+)
+
+const searchResultLimit = 20
+
+// Suggestion is a track a voter proposed for a playlist. Once its net votes
+// reach the playlist's suggestion threshold it is appended to the playlist.
+type Suggestion struct {
+	ID          int64     `json:"id"`
+	PlaylistID  string    `json:"playlist_id"`
+	TrackID     string    `json:"track_id"`
+	Name        string    `json:"name"`
+	Artists     string    `json:"artists"`
+	Album       string    `json:"album"`
+	ImageURL    string    `json:"image_url"`
+	URI         string    `json:"uri"`
+	SuggestedBy string    `json:"suggested_by"` // display name of whoever suggested it
+	Votes       int       `json:"votes"`
+	UserVote    int       `json:"user_vote"` // -1, 0, or 1
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func createSuggestionTables(db sqlExecutor) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS suggestions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			playlist_id TEXT NOT NULL,
+			track_id TEXT NOT NULL,
+			track_uri TEXT NOT NULL,
+			track_name TEXT NOT NULL,
+			track_artists TEXT NOT NULL,
+			track_album TEXT NOT NULL,
+			track_image_url TEXT,
+			suggested_by TEXT NOT NULL,
+			suggested_by_name TEXT NOT NULL,
+			votes INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			added_at TIMESTAMP,
+			UNIQUE(playlist_id, track_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS suggestion_votes (
+			user_id TEXT NOT NULL,
+			suggestion_id INTEGER NOT NULL,
+			vote INTEGER NOT NULL DEFAULT 0,
+			voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, suggestion_id)
+		)
+	`)
+	return err
+}
+
+// getSuggestion loads a suggestion with userID's vote on it.
+func (app *App) getSuggestion(id int64, userID string) (*Suggestion, error) {
+	s := &Suggestion{}
+	err := app.db.QueryRow(`
+		SELECT s.id, s.playlist_id, s.track_id, s.track_name, s.track_artists, s.track_album,
+		       COALESCE(s.track_image_url, ''), s.track_uri, s.suggested_by_name, s.votes, s.status,
+		       s.created_at, COALESCE(v.vote, 0)
+		FROM suggestions s
+		LEFT JOIN suggestion_votes v ON v.suggestion_id = s.id AND v.user_id = ?
+		WHERE s.id = ?
+	`, userID, id).Scan(&s.ID, &s.PlaylistID, &s.TrackID, &s.Name, &s.Artists, &s.Album,
+		&s.ImageURL, &s.URI, &s.SuggestedBy, &s.Votes, &s.Status, &s.CreatedAt, &s.UserVote)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// publishSuggestion tells the playlist's subscribers about a new or changed
+// suggestion. User votes are per viewer, so they are left out.
+func (app *App) publishSuggestion(s Suggestion) {
+	s.UserVote = 0
+	app.hub.Publish(Message{Type: MessageSuggestion, PlaylistID: s.PlaylistID, Data: s})
+}
+
+// acceptSuggestion appends the suggested track to the playlist. The status is
+// claimed first so concurrent votes can't add the track twice.
+func (app *App) acceptSuggestion(ctx context.Context, session *UserSession, s *Suggestion) error {
+	result, err := app.db.Exec(`
+		UPDATE suggestions SET status = ?, added_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+	`, SuggestionAdded, s.ID, SuggestionPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	if _, err := session.Client.AddTracksToPlaylist(ctx, spotify.ID(s.PlaylistID), spotify.ID(s.TrackID)); err != nil {
+		// Leave it pending so the next vote tries again
+		if _, dbErr := app.db.Exec(`
+			UPDATE suggestions SET status = ?, added_at = NULL WHERE id = ?
+		`, SuggestionPending, s.ID); dbErr != nil {
+			log.Printf("⚠️  Failed to reset suggestion %d: %v", s.ID, dbErr)
+		}
+		return err
+	}
+
+	s.Status = SuggestionAdded
+	log.Printf("💡 Suggestion %s - %s reached %d votes and was added to playlist %s",
+		s.Name, s.Artists, s.Votes, s.PlaylistID)
+	return nil
+}
+
+// playlistWriterSession returns a session that can add tracks to the
+// playlist: its Spotify owner's if they are logged in, otherwise the host's
+// for guests of a room on it. The voter's own session usually can't, unless
+// they happen to own or collaborate on the playlist.
+func (app *App) playlistWriterSession(ctx context.Context, voter *Voter, playlistID string) (*UserSession, error) {
+	readSession, err := app.sessionForPlaylist(voter, playlistID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, playlistOwnerTimeout)
+	owner, err := app.playlistOwner(ctx, readSession, playlistID)
+	cancel()
+	if err != nil {
+		log.Printf("⚠️  Failed to get owner of playlist %s: %v", playlistID, err)
+	} else if session := app.sessionForUser(owner); session != nil {
+		return session, nil
+	}
+
+	if voter.IsGuest() {
+		return readSession, nil
+	}
+	return nil, fmt.Errorf("owner of playlist %s is not logged in", playlistID)
+}
+
+// voteOnSuggestion toggles userID's vote on a suggestion and returns the
+// user's new vote and the suggestion's total, in one transaction so
+// concurrent clicks can't both count.
+func (app *App) voteOnSuggestion(userID string, suggestionID int64, vote int) (int, int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// Writing first takes SQLite's write lock, so no other vote can run
+	// between reading the user's vote and updating it
+	if _, err := tx.Exec(`
+		INSERT INTO suggestion_votes (user_id, suggestion_id, vote)
+		VALUES (?, ?, 0)
+		ON CONFLICT(user_id, suggestion_id) DO NOTHING
+	`, userID, suggestionID); err != nil {
+		return 0, 0, err
+	}
+	var current int
+	if err := tx.QueryRow(`
+		SELECT vote FROM suggestion_votes WHERE user_id = ? AND suggestion_id = ?
+	`, userID, suggestionID).Scan(&current); err != nil {
+		return 0, 0, err
+	}
+
+	newVote, delta := toggleVote(current, vote)
+	if _, err := tx.Exec(`
+		UPDATE suggestion_votes SET vote = ?, voted_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND suggestion_id = ?
+	`, newVote, userID, suggestionID); err != nil {
+		return 0, 0, err
+	}
+	var total int
+	if err := tx.QueryRow(`
+		UPDATE suggestions SET votes = votes + ? WHERE id = ? RETURNING votes
+	`, delta, suggestionID).Scan(&total); err != nil {
+		return 0, 0, err
+	}
+
+	return newVote, total, tx.Commit()
+}
+
+func (app *App) handleSearchTracks(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	// Guests search with the host's account
+	userSession := voter.Session
+	if voter.IsGuest() {
+		userSession, err = app.hostSession(voter.Room)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	results, err := userSession.Client.Search(r.Context(), query, spotify.SearchTypeTrack, spotify.Limit(searchResultLimit))
+	if err != nil {
+		log.Printf("⚠️  Search for %q failed for %s: %v", query, voter.Name, err)
+		http.Error(w, "Search failed", spotifyErrorStatus(err))
+		return
+	}
+
+	tracks := []Track{}
+	if results.Tracks != nil {
+		for i := range results.Tracks.Tracks {
+			tracks = append(tracks, trackFromSpotify(&results.Tracks.Tracks[i]))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracks)
+}
+
+func (app *App) handleGetSuggestions(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+	if voter.IsGuest() && voter.Room.PlaylistID != playlistID {
+		http.Error(w, "Guests can only access their room's playlist", http.StatusForbidden)
+		return
+	}
+
+	rows, err := app.db.Query(`
+		SELECT s.id, s.playlist_id, s.track_id, s.track_name, s.track_artists, s.track_album,
+		       COALESCE(s.track_image_url, ''), s.track_uri, s.suggested_by_name, s.votes, s.status,
+		       s.created_at, COALESCE(v.vote, 0)
+		FROM suggestions s
+		LEFT JOIN suggestion_votes v ON v.suggestion_id = s.id AND v.user_id = ?
+		WHERE s.playlist_id = ? AND s.status = ?
+		ORDER BY s.votes DESC, s.created_at ASC
+	`, voter.UserID, playlistID, SuggestionPending)
+	if err != nil {
+		log.Printf("Failed to get suggestions: %v", err)
+		http.Error(w, "Failed to get suggestions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.ID, &s.PlaylistID, &s.TrackID, &s.Name, &s.Artists, &s.Album,
+			&s.ImageURL, &s.URI, &s.SuggestedBy, &s.Votes, &s.Status, &s.CreatedAt, &s.UserVote); err != nil {
+			log.Printf("Error scanning suggestion: %v", err)
+			continue
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	settings, err := app.getPlaylistSettings(playlistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to get playlist settings: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"threshold":   settings.SuggestionThreshold,
+		"suggestions": suggestions,
+	})
+}
+
+func (app *App) handleCreateSuggestion(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	playlistID := mux.Vars(r)["id"]
+
+	var req struct {
+		TrackID string `json:"track_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.TrackID == "" {
+		http.Error(w, "track_id is required", http.StatusBadRequest)
+		return
+	}
+
+	userSession, err := app.sessionForPlaylist(voter, playlistID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// An earlier suggestion of the same track is shared rather than duplicated
+	var existingID int64
+	var status string
+	err = app.db.QueryRow(`
+		SELECT id, status FROM suggestions WHERE playlist_id = ? AND track_id = ?
+	`, playlistID, req.TrackID).Scan(&existingID, &status)
+	if err == nil {
+		if status == SuggestionAdded {
+			http.Error(w, "This track was already added to the playlist", http.StatusConflict)
+			return
+		}
+		suggestion, err := app.getSuggestion(existingID, voter.UserID)
+		if err != nil {
+			log.Printf("Failed to get suggestion: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suggestion)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to look up suggestion: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	fullTrack, err := userSession.Client.GetTrack(r.Context(), spotify.ID(req.TrackID))
+	if err != nil {
+		log.Printf("⚠️  Failed to get track %s: %v", req.TrackID, err)
+		http.Error(w, "Track not found", http.StatusNotFound)
+		return
+	}
+	track := trackFromSpotify(fullTrack)
+
+	result, err := app.db.Exec(`
+		INSERT INTO suggestions
+		(playlist_id, track_id, track_uri, track_name, track_artists, track_album, track_image_url, suggested_by, suggested_by_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, playlistID, track.ID, track.URI, track.Name, track.Artists, track.Album, track.ImageURL, voter.UserID, voter.Name)
+	if err != nil {
+		log.Printf("Failed to save suggestion: %v", err)
+		http.Error(w, "Failed to save suggestion", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	suggestion, err := app.getSuggestion(id, voter.UserID)
+	if err != nil {
+		log.Printf("Failed to get suggestion: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("💡 %s suggested %s - %s for playlist %s", voter.Name, track.Name, track.Artists, playlistID)
+	app.publishSuggestion(*suggestion)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestion)
+}
+
+func (app *App) handleVoteSuggestion(w http.ResponseWriter, r *http.Request) {
+	voter, err := app.getVoter(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	suggestionID, err := strconv.ParseInt(mux.Vars(r)["suggestionId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid suggestion ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Vote int `json:"vote"` // 1 for upvote, -1 for downvote
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Vote != 1 && req.Vote != -1 {
+		http.Error(w, "Vote must be 1 or -1", http.StatusBadRequest)
+		return
+	}
+
+	suggestion, err := app.getSuggestion(suggestionID, voter.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Suggestion not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get suggestion: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if voter.IsGuest() && voter.Room.PlaylistID != suggestion.PlaylistID {
+		http.Error(w, "Guests can only vote on their room's playlist", http.StatusForbidden)
+		return
+	}
+
+	if suggestion.Status != SuggestionPending {
+		http.Error(w, "This suggestion was already added to the playlist", http.StatusConflict)
+		return
+	}
+
+	newVote, total, err := app.voteOnSuggestion(voter.UserID, suggestionID, req.Vote)
+	if err != nil {
+		log.Printf("Failed to save suggestion vote: %v", err)
+		http.Error(w, "Failed to save vote", http.StatusInternalServerError)
+		return
+	}
+	suggestion.UserVote = newVote
+	suggestion.Votes = total
+
+	log.Printf("💡 %s voted %d on suggestion %d (now: %d, total: %d)",
+		voter.Name, req.Vote, suggestionID, newVote, suggestion.Votes)
+
+	settings, err := app.getPlaylistSettings(suggestion.PlaylistID)
+	if err != nil {
+		log.Printf("⚠️  Failed to get playlist settings: %v", err)
+	} else if suggestion.Votes >= settings.SuggestionThreshold {
+		userSession, err := app.playlistWriterSession(r.Context(), voter, suggestion.PlaylistID)
+		if err == nil {
+			err = app.acceptSuggestion(r.Context(), userSession, suggestion)
+		}
+		if err != nil {
+			log.Printf("⚠️  Failed to add suggestion %d to playlist %s: %v", suggestionID, suggestion.PlaylistID, err)
+		}
+	}
+
+	app.publishSuggestion(*suggestion)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestion)
+}
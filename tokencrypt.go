@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Encrypted token columns look like "enc:v1:<key id>:<base64(nonce|ciphertext)>".
+// Anything without the prefix is a plaintext token from before encryption.
+const encryptedTokenPrefix = "enc:v1:"
+
+// tokenKeyring encrypts Spotify tokens stored in the sessions table with
+// AES-256-GCM. New values are encrypted with the first key; the others are
+// kept to decrypt rows written before a key rotation.
+type tokenKeyring struct {
+	primary string                 // ID of the key used for encryption
+	aeads   map[string]cipher.AEAD // key ID -> cipher
+
+	// Set once the startup migration encrypted the plaintext tokens: from
+	// then on a plaintext value wasn't written by the app and is rejected
+	rejectPlaintext bool
+}
+
+// newTokenKeyring parses TOKEN_KEYS: comma-separated, hex-encoded 32-byte keys,
+// newest first. An empty list means tokens are stored in plaintext.
+func newTokenKeyring(keys string) (*tokenKeyring, error) {
+	keyring := &tokenKeyring{aeads: make(map[string]cipher.AEAD)}
+
+	for _, encoded := range strings.Split(keys, ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := hex.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("token keys must be 32 bytes, hex encoded (64 characters)")
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		id := tokenKeyID(key)
+		keyring.aeads[id] = aead
+		if keyring.primary == "" {
+			keyring.primary = id
+		}
+	}
+
+	return keyring, nil
+}
+
+// tokenKeyID identifies a key in stored values without revealing it.
+func tokenKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func (k *tokenKeyring) enabled() bool {
+	return k.primary != ""
+}
+
+// encrypt seals a token for the given row and column, so a ciphertext can't
+// be copied into another session.
+func (k *tokenKeyring) encrypt(sessionID, column, token string) (string, error) {
+	if !k.enabled() || token == "" {
+		return token, nil
+	}
+
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(sessionID+"/"+column))
+	return encryptedTokenPrefix + k.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a stored token. Plaintext values are returned unchanged,
+// unless rejectPlaintext is set.
+func (k *tokenKeyring) decrypt(sessionID, column, stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		if k.rejectPlaintext && stored != "" {
+			return "", fmt.Errorf("plaintext token while token encryption is enabled")
+		}
+		return stored, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, encryptedTokenPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted token")
+	}
+	aead := k.aeads[id]
+	if aead == nil {
+		return "", fmt.Errorf("token encrypted with unknown key %s", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted token")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(sessionID+"/"+column))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// plaintextToken reports whether a stored value is a token from before
+// encryption was enabled.
+func plaintextToken(stored string) bool {
+	return stored != "" && !strings.HasPrefix(stored, encryptedTokenPrefix)
+}
+
+// current reports whether a stored value is already encrypted with the
+// primary key.
+func (k *tokenKeyring) current(stored string) bool {
+	if !k.enabled() {
+		return !strings.HasPrefix(stored, encryptedTokenPrefix)
+	}
+	return stored == "" || strings.HasPrefix(stored, encryptedTokenPrefix+k.primary+":")
+}
+
+// reencryptTokens rewrites stored tokens with the primary key. With
+// plaintextOnly it only encrypts rows from before encryption was enabled;
+// otherwise it also re-encrypts rows under older keys, after which those keys
+// can be removed from TOKEN_KEYS. Rows that no key decrypts are logged and
+// left alone; their users have to log in again.
+func reencryptTokens(store Store, keys *tokenKeyring, plaintextOnly bool) (int, error) {
+	sessions, err := store.LoadSessions()
+	if err != nil {
+		return 0, err
+	}
+
+	stale := []StoredSession{}
+sessions:
+	for _, session := range sessions {
+		if keys.current(session.AccessToken) && keys.current(session.RefreshToken) {
+			continue
+		}
+		plaintext := plaintextToken(session.AccessToken) || plaintextToken(session.RefreshToken)
+		if plaintextOnly && !plaintext {
+			continue
+		}
+
+		for _, column := range []struct {
+			name  string
+			value *string
+		}{
+			{"access_token", &session.AccessToken},
+			{"refresh_token", &session.RefreshToken},
+		} {
+			token, err := keys.decrypt(session.SessionID, column.name, *column.value)
+			if err != nil {
+				log.Printf("⚠️  Skipping session %s, can't decrypt its %s: %v", shortSessionID(session.SessionID), column.name, err)
+				continue sessions
+			}
+			if *column.value, err = keys.encrypt(session.SessionID, column.name, token); err != nil {
+				return 0, err
+			}
+		}
+		stale = append(stale, session)
+	}
+
+	if err := store.ReplaceSessionTokens(stale); err != nil {
+		return 0, err
+	}
+	return len(stale), nil
+}
+
+// runRotateTokenKeys is the rotate-token-keys command: it re-encrypts every
+// stored token with the first key in TOKEN_KEYS.
+func runRotateTokenKeys() {
+	if !tokenKeys.enabled() {
+		log.Fatal("TOKEN_KEYS must be set to rotate token keys")
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	dataStore, err := openStore(db)
+	if err != nil {
+		log.Fatal("Failed to open store:", err)
+	}
+	defer dataStore.Close()
+
+	n, err := reencryptTokens(dataStore, tokenKeys, false)
+	if err != nil {
+		log.Fatal("Failed to re-encrypt tokens:", err)
+	}
+	log.Printf("🔐 Re-encrypted tokens of %d sessions with key %s", n, tokenKeys.primary)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testTokenKey      = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testOtherTokenKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func mustTokenKeyring(t *testing.T, keys string) *tokenKeyring {
+	t.Helper()
+
+	keyring, err := newTokenKeyring(keys)
+	if err != nil {
+		t.Fatalf("newTokenKeyring(%q): %v", keys, err)
+	}
+	return keyring
+}
+
+func TestNewTokenKeyring(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        string
+		wantEnabled bool
+		wantErr     bool
+	}{
+		{"no keys", "", false, false},
+		{"one key", testTokenKey, true, false},
+		{"rotation", testOtherTokenKey + ", " + testTokenKey, true, false},
+		{"too short", "0001", false, true},
+		{"not hex", strings.Repeat("zz", 32), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := newTokenKeyring(tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTokenKeyring() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && keyring.enabled() != tt.wantEnabled {
+				t.Errorf("enabled() = %v, want %v", keyring.enabled(), tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestTokenKeyringRoundTrip(t *testing.T) {
+	old := mustTokenKeyring(t, testTokenKey)
+	rotated := mustTokenKeyring(t, testOtherTokenKey+","+testTokenKey)
+	other := mustTokenKeyring(t, testOtherTokenKey)
+	plain := mustTokenKeyring(t, "")
+
+	sealed, err := old.encrypt("s1", "access_token", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, encryptedTokenPrefix) || strings.Contains(sealed, "secret") {
+		t.Fatalf("encrypt() = %q", sealed)
+	}
+
+	tests := []struct {
+		name      string
+		keys      *tokenKeyring
+		sessionID string
+		column    string
+		stored    string
+		want      string
+		wantErr   bool
+	}{
+		{"same key", old, "s1", "access_token", sealed, "secret", false},
+		{"older key after rotation", rotated, "s1", "access_token", sealed, "secret", false},
+		{"key removed", other, "s1", "access_token", sealed, "", true},
+		{"copied to another session", old, "s2", "access_token", sealed, "", true},
+		{"copied to another column", old, "s1", "refresh_token", sealed, "", true},
+		{"tampered", old, "s1", "access_token", sealed[:len(sealed)-4] + "AAAA", "", true},
+		{"malformed", old, "s1", "access_token", encryptedTokenPrefix + "nokey", "", true},
+		{"plaintext", old, "s1", "access_token", "plain", "plain", false},
+		{"plaintext without keys", plain, "s1", "access_token", "plain", "plain", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keys.decrypt(tt.sessionID, tt.column, tt.stored)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decrypt() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("decrypt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenKeyringRejectPlaintext(t *testing.T) {
+	keys := mustTokenKeyring(t, testTokenKey)
+	keys.rejectPlaintext = true
+
+	if _, err := keys.decrypt("s1", "access_token", "plain"); err == nil {
+		t.Error("decrypt() accepted a plaintext token after the migration")
+	}
+	if got, err := keys.decrypt("s1", "refresh_token", ""); err != nil || got != "" {
+		t.Errorf("decrypt() of a missing refresh token = %q, %v", got, err)
+	}
+}
+
+func TestTokenKeyringCurrent(t *testing.T) {
+	old := mustTokenKeyring(t, testTokenKey)
+	rotated := mustTokenKeyring(t, testOtherTokenKey+","+testTokenKey)
+	plain := mustTokenKeyring(t, "")
+
+	sealedOld, _ := old.encrypt("s1", "access_token", "secret")
+	sealedNew, _ := rotated.encrypt("s1", "access_token", "secret")
+
+	tests := []struct {
+		name   string
+		keys   *tokenKeyring
+		stored string
+		want   bool
+	}{
+		{"primary key", rotated, sealedNew, true},
+		{"older key", rotated, sealedOld, false},
+		{"plaintext", rotated, "plain", false},
+		{"empty", rotated, "", true},
+		{"plaintext without keys", plain, "plain", true},
+		{"encrypted without keys", plain, sealedOld, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.keys.current(tt.stored); got != tt.want {
+				t.Errorf("current() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
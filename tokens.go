@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Tokens are refreshed this long before they expire, so background jobs
+	// never start a call with a token that runs out halfway
+	tokenRefreshMargin = 5 * time.Minute
+
+	tokenRefreshTimeout = 15 * time.Second
+)
+
+// errSessionRevoked means Spotify refused to refresh a session's token, e.g.
+// because the user removed the app's access. The session is ended and the
+// user has to log in again.
+var errSessionRevoked = errors.New("spotify access was revoked, log in again")
+
+// persistingTokenSource is the token source of one session. It refreshes the
+// token before it expires, keeps UserSession.Token up to date and saves every
+// new token to the database, so a restart picks up the latest refresh token.
+type persistingTokenSource struct {
+	app       *App
+	sessionID string
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.AccessToken != "" && time.Until(s.token.Expiry) > tokenRefreshMargin {
+		return s.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(spotifyContext(context.Background()), tokenRefreshTimeout)
+	defer cancel()
+
+	// Without an access token the authenticator always asks Spotify for a new one
+	token, err := auth.RefreshToken(ctx, &oauth2.Token{RefreshToken: s.token.RefreshToken})
+	if err != nil {
+		if tokenRevoked(err) {
+			log.Printf("🔒 Spotify refused to refresh session %s, ending it: %v", shortSessionID(s.sessionID), err)
+			s.app.endSessions([]string{s.sessionID})
+			return nil, fmt.Errorf("%w: %v", errSessionRevoked, err)
+		}
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = s.token.RefreshToken
+	}
+	s.token = token
+
+	s.app.mu.Lock()
+	session := s.app.sessions[s.sessionID]
+	if session != nil {
+		session.Token = token
+		session.LastRefresh = time.Now()
+	}
+	s.app.mu.Unlock()
+
+	if err := s.app.saveSessionToken(s.sessionID, token); err != nil {
+		log.Printf("⚠️  Failed to save refreshed token: %v", err)
+	}
+
+	return token, nil
+}
+
+// tokenRevoked reports whether a refresh failed because the grant is no
+// longer valid, as opposed to Spotify or the network being unavailable.
+func tokenRevoked(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	// invalid_client etc. are configuration errors that affect every session
+	if retrieveErr.ErrorCode != "" {
+		return retrieveErr.ErrorCode == "invalid_grant"
+	}
+	return retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusBadRequest
+}
+
+// spotifyErrorStatus is the status to answer a failed Spotify call with: 401
+// when the session was ended because its token can't be refreshed, so the
+// frontend sends the user to log in again, 429 when Spotify still throttled
+// the call after retrying and 502 when Spotify failed.
+func spotifyErrorStatus(err error) int {
+	if errors.Is(err, errSessionRevoked) {
+		return http.StatusUnauthorized
+	}
+	switch status := errSpotifyStatus(err); {
+	case status == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	case status >= 500:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// newUserSession sets up the clients of a session. The Spotify client and
+// HTTPClient, for Web API calls the library doesn't cover, share one token
+// source, so both always use the latest token, and spotifyTransport, so both
+// retry throttled and failed calls.
+func (app *App) newUserSession(sessionID, userID string, token *oauth2.Token) *UserSession {
+	tokenSource := &persistingTokenSource{app: app, sessionID: sessionID, token: token}
+	httpClient := oauth2.NewClient(spotifyContext(context.Background()), tokenSource)
+
+	return &UserSession{
+		Client:      spotify.New(httpClient),
+		HTTPClient:  httpClient,
+		Token:       token,
+		UserID:      userID,
+		TokenSource: tokenSource,
+		LastRefresh: time.Now(),
+	}
+}
+
+// saveSessionToken writes a refreshed token to the session's row. Sessions
+// that were ended in the meantime aren't brought back.
+func (app *App) saveSessionToken(sessionID string, token *oauth2.Token) error {
+	accessToken, err := tokenKeys.encrypt(sessionID, "access_token", token.AccessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := tokenKeys.encrypt(sessionID, "refresh_token", token.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	return app.store.UpdateSessionToken(sessionID, accessToken, refreshToken, token.Expiry)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The playlist tracks endpoint filters, sorts and pages the playlist on the
+// server, see trackQuery. Pages are chained with a cursor holding the sort key
+// of the last track of the previous page, so votes that move tracks between
+// two page loads don't repeat or skip the tracks that didn't move. Hot scores
+// decay all the time, so every page of a listing scores them at the time of
+// its first page.
+
+const (
+	defaultTrackPageSize = 50
+	maxTrackPageSize     = 500
+)
+
+// Orders of the playlist tracks
+const (
+	SortVotes  = "votes"  // score under the ranking, then net votes
+	SortAdded  = "added"  // when the track was added to the playlist
+	SortName   = "name"   // track name, then artists
+	SortArtist = "artist" // artists, then track name
+)
+
+// trackQuery is what a playlist tracks request asks for.
+type trackQuery struct {
+	Sort       string
+	Descending bool
+	Ranking    string    // the score for SortVotes
+	ScoredAt   time.Time // when hot scores are taken, see hotScores
+	Limit      int
+	After      *trackCursor // the last track of the previous page
+
+	Search   string // in name, artists and album, lower case
+	Unvoted  bool   // only tracks the user didn't vote on
+	Negative bool   // only tracks with a negative net score
+	AddedBy  string // only tracks this Spotify user added
+}
+
+// trackCursor is the sort key of a track, and the listing it's from. Ties are
+// broken by the position in the playlist, so every track has its own place.
+type trackCursor struct {
+	Score    float64   `json:"s,omitempty"`
+	Votes    int       `json:"v,omitempty"`
+	Name     string    `json:"n,omitempty"`
+	Artists  string    `json:"a,omitempty"`
+	AddedAt  time.Time `json:"t"`
+	Position int       `json:"p"`
+
+	Sort       string     `json:"o"`
+	Descending bool       `json:"d,omitempty"`
+	Ranking    string     `json:"r"`
+	ScoredAt   *time.Time `json:"at,omitempty"` // hot ranking only
+}
+
+// cursorFor is the track's sort key in the query's listing.
+func (q trackQuery) cursorFor(track Track) trackCursor {
+	cursor := trackCursor{
+		Score:      track.Score,
+		Votes:      track.Votes,
+		Name:       track.Name,
+		Artists:    track.Artists,
+		AddedAt:    track.AddedAt,
+		Position:   track.Position,
+		Sort:       q.Sort,
+		Descending: q.Descending,
+		Ranking:    q.Ranking,
+	}
+	if q.Ranking == RankHot {
+		scoredAt := q.ScoredAt
+		cursor.ScoredAt = &scoredAt
+	}
+	return cursor
+}
+
+func (c trackCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTrackCursor(raw string) (*trackCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor trackCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// parseTrackQuery reads ?sort=votes|added|name|artist, ?order=asc|desc (votes
+// and added default to desc, name and artist to asc), ?rank=, ?q=,
+// ?unvoted=true, ?negative=true, ?added_by=, ?limit= and ?cursor=. A cursor
+// only continues the listing it came from.
+func parseTrackQuery(r *http.Request, now time.Time) (trackQuery, error) {
+	params := r.URL.Query()
+
+	query := trackQuery{
+		Sort:     params.Get("sort"),
+		ScoredAt: now,
+		Search:   strings.ToLower(strings.TrimSpace(params.Get("q"))),
+		AddedBy:  params.Get("added_by"),
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = SortVotes
+		query.Descending = true
+	case SortVotes, SortAdded:
+		query.Descending = true
+	case SortName, SortArtist:
+	default:
+		return query, fmt.Errorf("sort must be %s, %s, %s or %s", SortVotes, SortAdded, SortName, SortArtist)
+	}
+
+	switch order := params.Get("order"); order {
+	case "":
+	case "asc", "desc":
+		query.Descending = order == "desc"
+	default:
+		return query, fmt.Errorf("order must be asc or desc")
+	}
+
+	var err error
+	if query.Ranking, err = requestRanking(r); err != nil {
+		return query, err
+	}
+	if query.Limit, err = queryInt(r, "limit", defaultTrackPageSize, maxTrackPageSize); err != nil {
+		return query, err
+	}
+	if raw := params.Get("cursor"); raw != "" {
+		if query.After, err = decodeTrackCursor(raw); err != nil {
+			return query, err
+		}
+		after := query.After
+		if after.Sort != query.Sort || after.Descending != query.Descending || after.Ranking != query.Ranking {
+			return query, fmt.Errorf("cursor is from a listing with another sort, order or rank")
+		}
+		if after.ScoredAt != nil {
+			query.ScoredAt = *after.ScoredAt
+		}
+	}
+	if query.Unvoted, err = queryBool(r, "unvoted"); err != nil {
+		return query, err
+	}
+	if query.Negative, err = queryBool(r, "negative"); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// queryBool reads a true/false query parameter, false if missing.
+func queryBool(r *http.Request, name string) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return value, nil
+}
+
+func (q trackQuery) matches(track Track) bool {
+	if q.Unvoted && track.UserVote != 0 {
+		return false
+	}
+	if q.Negative && track.Votes >= 0 {
+		return false
+	}
+	if q.AddedBy != "" && track.AddedBy != q.AddedBy {
+		return false
+	}
+	if q.Search != "" {
+		text := strings.ToLower(track.Name + "\n" + track.Artists + "\n" + track.Album)
+		if !strings.Contains(text, q.Search) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare orders two tracks under the query's sort: negative if a comes
+// first.
+func (q trackQuery) compare(a, b trackCursor) int {
+	order := 0
+	switch q.Sort {
+	case SortVotes:
+		order = compareFloat(a.Score, b.Score)
+		if order == 0 {
+			order = a.Votes - b.Votes
+		}
+	case SortAdded:
+		order = a.AddedAt.Compare(b.AddedAt)
+	case SortName:
+		order = compareFold(a.Name, b.Name)
+		if order == 0 {
+			order = compareFold(a.Artists, b.Artists)
+		}
+	case SortArtist:
+		order = compareFold(a.Artists, b.Artists)
+		if order == 0 {
+			order = compareFold(a.Name, b.Name)
+		}
+	}
+	if q.Descending {
+		order = -order
+	}
+	if order == 0 {
+		order = a.Position - b.Position
+	}
+	return order
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFold(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// apply filters and sorts the tracks and returns the requested page, plus
+// how many tracks matched and the cursor of the next page ("" on the last).
+func (q trackQuery) apply(tracks []Track) (page []Track, matched int, nextCursor string) {
+	filtered := []Track{}
+	for _, track := range tracks {
+		if q.matches(track) {
+			filtered = append(filtered, track)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return q.compare(q.cursorFor(filtered[i]), q.cursorFor(filtered[j])) < 0
+	})
+
+	start := 0
+	if q.After != nil {
+		start = sort.Search(len(filtered), func(i int) bool {
+			return q.compare(q.cursorFor(filtered[i]), *q.After) > 0
+		})
+	}
+	end := min(start+q.Limit, len(filtered))
+
+	page = filtered[start:end]
+	if end < len(filtered) {
+		nextCursor = q.cursorFor(filtered[end-1]).encode()
+	}
+	return page, len(filtered), nextCursor
+}
+
+// playlistAdders returns the Spotify users who added tracks to the playlist.
+func playlistAdders(tracks []Track) []string {
+	seen := make(map[string]bool)
+	adders := []string{}
+	for _, track := range tracks {
+		if track.AddedBy != "" && !seen[track.AddedBy] {
+			seen[track.AddedBy] = true
+			adders = append(adders, track.AddedBy)
+		}
+	}
+	sort.Strings(adders)
+	return adders
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testTracks is a playlist with ties in every sort key, so pages have to be
+// chained by position too.
+func testTracks() []Track {
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	tracks := []Track{
+		{ID: "a", Name: "Alpha", Artists: "Zed", Album: "One", Votes: 3, UserVote: 1},
+		{ID: "b", Name: "bravo", Artists: "Yan", Album: "One", Votes: -2, UserVote: -1},
+		{ID: "c", Name: "Charlie", Artists: "Zed", Album: "Two", Votes: 3},
+		{ID: "d", Name: "Delta", Artists: "Xia", Album: "Two", Votes: 0},
+		{ID: "e", Name: "Alpha", Artists: "Yan", Album: "Three", Votes: 3},
+		{ID: "f", Name: "Foxtrot", Artists: "Xia", Album: "Three", Votes: -1},
+		{ID: "g", Name: "Golf", Artists: "Zed", Album: "Four", Votes: 0, UserVote: 1},
+	}
+	for i := range tracks {
+		tracks[i].URI = "spotify:track:" + tracks[i].ID
+		tracks[i].Position = i
+		tracks[i].Score = float64(tracks[i].Votes)
+		// Two tracks added at the same time
+		tracks[i].AddedAt = start.Add(time.Duration(i/2) * time.Minute)
+		tracks[i].AddedBy = []string{"host", "guest"}[i%2]
+	}
+	return tracks
+}
+
+func trackIDs(tracks []Track) string {
+	ids := ""
+	for _, track := range tracks {
+		ids += track.ID
+	}
+	return ids
+}
+
+// pageThrough requests pages of limit tracks until the last one, following
+// the cursors, and returns the tracks in the order they came.
+func pageThrough(t *testing.T, query trackQuery, tracks []Track, limit int) []Track {
+	t.Helper()
+
+	query.Limit = limit
+	query.After = nil
+	all := []Track{}
+	for pages := 0; ; pages++ {
+		if pages > len(tracks) {
+			t.Fatalf("no last page after %d pages", pages)
+		}
+		page, _, next := query.apply(tracks)
+		all = append(all, page...)
+		if next == "" {
+			return all
+		}
+		cursor, err := decodeTrackCursor(next)
+		if err != nil {
+			t.Fatalf("decodeTrackCursor(%q): %v", next, err)
+		}
+		query.After = cursor
+	}
+}
+
+func TestTrackQueryApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		query trackQuery
+		want  string // track IDs in order
+	}{
+		{"votes", trackQuery{Sort: SortVotes, Descending: true}, "acedgfb"},
+		{"votes ascending", trackQuery{Sort: SortVotes}, "bfdgace"},
+		{"added", trackQuery{Sort: SortAdded, Descending: true}, "gefcdab"},
+		{"name", trackQuery{Sort: SortName}, "eabcdfg"},
+		{"artist", trackQuery{Sort: SortArtist}, "dfebacg"},
+		{"search", trackQuery{Sort: SortName, Search: "alpha"}, "ea"},
+		{"search album", trackQuery{Sort: SortName, Search: "three"}, "ef"},
+		{"unvoted", trackQuery{Sort: SortVotes, Descending: true, Unvoted: true}, "cedf"},
+		{"negative", trackQuery{Sort: SortVotes, Descending: true, Negative: true}, "fb"},
+		{"added by", trackQuery{Sort: SortName, AddedBy: "guest"}, "bdf"},
+		{"no match", trackQuery{Sort: SortVotes, Search: "nothing"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracks := testTracks()
+
+			query := tt.query
+			query.Limit = maxTrackPageSize
+			page, matched, next := query.apply(tracks)
+			if got := trackIDs(page); got != tt.want {
+				t.Errorf("one page = %q, want %q", got, tt.want)
+			}
+			if matched != len(tt.want) {
+				t.Errorf("matched = %d, want %d", matched, len(tt.want))
+			}
+			if next != "" {
+				t.Errorf("next cursor = %q on the only page", next)
+			}
+
+			for limit := 1; limit <= len(tracks); limit++ {
+				if got := trackIDs(pageThrough(t, tt.query, tracks, limit)); got != tt.want {
+					t.Errorf("pages of %d = %q, want %q", limit, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// Votes between two page loads move tracks; the tracks that didn't move are
+// neither repeated nor skipped. A moved track shows again, or not at all,
+// depending on where it moved.
+func TestTrackQueryApplyVotesBetweenPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		moved  string
+		votes  int
+		before string // the first page
+		after  string // the following pages
+	}{
+		{"track on the next page moves up", "f", 10, "ace", "dgb"},
+		{"track on the first page moves down", "a", -10, "ace", "dgfba"},
+		{"track on the next page moves down", "d", -10, "ace", "gfbd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := trackQuery{Sort: SortVotes, Descending: true, Limit: 3}
+			tracks := testTracks()
+
+			page, _, next := query.apply(tracks)
+			if got := trackIDs(page); got != tt.before {
+				t.Fatalf("first page = %q, want %q", got, tt.before)
+			}
+
+			for i := range tracks {
+				if tracks[i].ID == tt.moved {
+					tracks[i].Votes = tt.votes
+					tracks[i].Score = float64(tt.votes)
+				}
+			}
+
+			rest := ""
+			for next != "" {
+				cursor, err := decodeTrackCursor(next)
+				if err != nil {
+					t.Fatal(err)
+				}
+				query.After = cursor
+				page, _, next = query.apply(tracks)
+				rest += trackIDs(page)
+			}
+			if rest != tt.after {
+				t.Errorf("following pages = %q, want %q", rest, tt.after)
+			}
+		})
+	}
+}
+
+func TestParseTrackQuery(t *testing.T) {
+	cursor := trackCursor{Votes: 3, Position: 2, Sort: SortVotes, Descending: true, Ranking: RankNet}.encode()
+
+	tests := []struct {
+		query          string
+		wantSort       string
+		wantDescending bool
+		wantLimit      int
+		wantErr        bool
+	}{
+		{"", SortVotes, true, defaultTrackPageSize, false},
+		{"sort=name", SortName, false, defaultTrackPageSize, false},
+		{"sort=added&order=asc", SortAdded, false, defaultTrackPageSize, false},
+		{"sort=artist&order=desc&limit=10", SortArtist, true, 10, false},
+		{"cursor=" + cursor, SortVotes, true, defaultTrackPageSize, false},
+		{"sort=name&cursor=" + cursor, "", false, 0, true},
+		{"order=asc&cursor=" + cursor, "", false, 0, true},
+		{"rank=hot&cursor=" + cursor, "", false, 0, true},
+		{"sort=random", "", false, 0, true},
+		{"order=sideways", "", false, 0, true},
+		{"unvoted=maybe", "", false, 0, true},
+		{"cursor=not-a-cursor!", "", false, 0, true},
+		{fmt.Sprintf("limit=%d", maxTrackPageSize+1), "", false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/playlist/p/tracks?"+tt.query, nil)
+			query, err := parseTrackQuery(r, time.Now())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTrackQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if query.Sort != tt.wantSort || query.Descending != tt.wantDescending || query.Limit != tt.wantLimit {
+				t.Errorf("parseTrackQuery() = %s desc=%v limit=%d, want %s desc=%v limit=%d",
+					query.Sort, query.Descending, query.Limit, tt.wantSort, tt.wantDescending, tt.wantLimit)
+			}
+		})
+	}
+}
+
+// Later pages of a hot listing score the tracks when the first page did.
+func TestParseTrackQueryHotCursor(t *testing.T) {
+	first := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+
+	r := httptest.NewRequest("GET", "/api/playlist/p/tracks?rank=hot&limit=2", nil)
+	query, err := parseTrackQuery(r, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, next := query.apply(testTracks())
+	if next == "" {
+		t.Fatal("no next cursor")
+	}
+
+	r = httptest.NewRequest("GET", "/api/playlist/p/tracks?rank=hot&limit=2&cursor="+next, nil)
+	query, err = parseTrackQuery(r, first.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !query.ScoredAt.Equal(first) {
+		t.Errorf("ScoredAt = %v, want %v", query.ScoredAt, first)
+	}
+
+	r = httptest.NewRequest("GET", "/api/playlist/p/tracks?limit=2&cursor="+next, nil)
+	if _, err := parseTrackQuery(r, first); err == nil {
+		t.Error("parseTrackQuery() accepted a hot cursor for the net ranking")
+	}
+}
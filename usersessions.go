@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultSessionIdleTimeout     = 7 * 24 * time.Hour
+	defaultSessionAbsoluteTimeout = 30 * 24 * time.Hour
+
+	sessionJanitorInterval = 10 * time.Minute
+
+	// How stale last_seen_at may get in the database; saves a write per request
+	lastSeenSaveInterval = 5 * time.Minute
+
+	// How long a session in memory is trusted without looking at its database
+	// row, which another instance may have deleted (logout on all devices)
+	sessionRecheckInterval = 30 * time.Second
+)
+
+// A session ends after sessionIdleTimeout without requests, and at the latest
+// sessionAbsoluteTimeout after login. Both can be set with
+// SESSION_IDLE_TIMEOUT and SESSION_ABSOLUTE_TIMEOUT (e.g. "72h").
+var (
+	sessionIdleTimeout     = defaultSessionIdleTimeout
+	sessionAbsoluteTimeout = defaultSessionAbsoluteTimeout
+)
+
+func loadSessionTimeouts() error {
+	for _, setting := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"SESSION_IDLE_TIMEOUT", &sessionIdleTimeout},
+		{"SESSION_ABSOLUTE_TIMEOUT", &sessionAbsoluteTimeout},
+	} {
+		raw := os.Getenv(setting.env)
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s must be a positive duration like 72h", setting.env)
+		}
+		*setting.value = d
+	}
+	return nil
+}
+
+// generateSessionID returns an opaque, unguessable session ID.
+func generateSessionID() (string, error) {
+	return randomHex(32)
+}
+
+// shortSessionID shortens a session ID for logs, which shouldn't contain
+// usable session IDs.
+func shortSessionID(id string) string {
+	if len(id) > 8 {
+		return id[:8] + "…"
+	}
+	return id
+}
+
+func (s *UserSession) expired(now time.Time) bool {
+	return now.Sub(s.LastSeen) > sessionIdleTimeout || now.Sub(s.CreatedAt) > sessionAbsoluteTimeout
+}
+
+// touchSession records activity on a session, writing it to the database at
+// most every lastSeenSaveInterval.
+func (app *App) touchSession(sessionID string, session *UserSession) {
+	now := time.Now()
+
+	app.mu.Lock()
+	session.LastSeen = now
+	save := now.Sub(session.lastSeenSaved) > lastSeenSaveInterval
+	if save {
+		session.lastSeenSaved = now
+	}
+	app.mu.Unlock()
+
+	if !save {
+		return
+	}
+	if err := app.store.TouchSession(sessionID, now); err != nil {
+		log.Printf("⚠️  Failed to save session activity: %v", err)
+	}
+}
+
+// endSessions removes sessions from memory and the database.
+func (app *App) endSessions(sessionIDs []string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+
+	app.mu.Lock()
+	for _, id := range sessionIDs {
+		delete(app.sessions, id)
+	}
+	app.mu.Unlock()
+
+	if err := app.store.DeleteSessions(sessionIDs...); err != nil {
+		log.Printf("⚠️  Failed to delete sessions from database: %v", err)
+	}
+}
+
+// sessionStored reports whether the session's database row still exists,
+// looking at most every sessionRecheckInterval. A session whose row is gone
+// was ended by another instance and is dropped from memory. Database errors
+// keep the session, so an outage doesn't log everyone out.
+func (app *App) sessionStored(sessionID string, session *UserSession) bool {
+	now := time.Now()
+
+	app.mu.Lock()
+	check := now.Sub(session.checkedAt) > sessionRecheckInterval
+	if check {
+		session.checkedAt = now
+	}
+	app.mu.Unlock()
+
+	if !check {
+		return true
+	}
+
+	_, found, err := app.store.GetSession(sessionID)
+	if err != nil {
+		log.Printf("⚠️  Failed to check session: %v", err)
+		return true
+	}
+	if found {
+		return true
+	}
+
+	app.mu.Lock()
+	delete(app.sessions, sessionID)
+	app.mu.Unlock()
+	return false
+}
+
+// loadSessionFromStore loads a session that isn't in memory, e.g. one created
+// by another instance. It returns nil if there is no such session or it has
+// expired.
+func (app *App) loadSessionFromStore(sessionID string) (*UserSession, error) {
+	stored, found, err := app.store.GetSession(sessionID)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	userSession, err := app.sessionFromStore(stored)
+	if err != nil || userSession == nil {
+		return nil, err
+	}
+	userSession.checkedAt = time.Now()
+
+	app.mu.Lock()
+	if existing, ok := app.sessions[sessionID]; ok {
+		userSession = existing
+	} else {
+		app.sessions[sessionID] = userSession
+	}
+	app.mu.Unlock()
+	return userSession, nil
+}
+
+// expireSessionsPeriodically is the session janitor: it ends sessions that
+// passed their idle or absolute timeout, in memory and in the database.
+func (app *App) expireSessionsPeriodically() {
+	ticker := time.NewTicker(sessionJanitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.expireSessions()
+	}
+}
+
+func (app *App) expireSessions() {
+	now := time.Now()
+
+	app.mu.RLock()
+	expired := []string{}
+	for id, session := range app.sessions {
+		if session.expired(now) {
+			expired = append(expired, id)
+		}
+	}
+	app.mu.RUnlock()
+
+	app.endSessions(expired)
+
+	// Also catches rows that were never loaded, e.g. skipped at startup
+	purged, err := app.store.DeleteExpiredSessions(now.Add(-sessionAbsoluteTimeout), now.Add(-sessionIdleTimeout))
+	if err != nil {
+		log.Printf("⚠️  Failed to delete expired sessions: %v", err)
+		return
+	}
+
+	if len(expired) > 0 || purged > 0 {
+		log.Printf("🧹 Expired %d sessions (%d rows removed from database)", len(expired), purged)
+	}
+}
+
+// handleLogoutAll ends every session of the current user, on all devices.
+func (app *App) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userSession, err := app.getSession(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	app.mu.RLock()
+	sessionIDs := []string{}
+	for id, session := range app.sessions {
+		if session.UserID == userSession.UserID {
+			sessionIDs = append(sessionIDs, id)
+		}
+	}
+	app.mu.RUnlock()
+
+	app.endSessions(sessionIDs)
+
+	// Rows of sessions that aren't loaded in memory
+	if err := app.store.DeleteUserSessions(userSession.UserID); err != nil {
+		log.Printf("⚠️  Failed to delete sessions from database: %v", err)
+	}
+
+	session, _ := store.Get(r, "spotify-session")
+	session.Values["id"] = ""
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+
+	log.Printf("🚪 User %s logged out on all devices (%d sessions)", userSession.UserID, len(sessionIDs))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"sessions_ended": len(sessionIDs),
+	})
+}
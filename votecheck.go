@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// user_votes is the record of who voted what; the totals in votes are derived
+// from it and can drift, e.g. after a crash or a restore from an older
+// backup. checkVotes compares the two and, when asked, repairs the totals.
+
+// checkVotesOnStartup checks all totals before the server takes requests.
+// Mismatches are only reported unless VOTE_CHECK_REPAIR is true.
+func checkVotesOnStartup(store Store) {
+	repair := false
+	if value := os.Getenv("VOTE_CHECK_REPAIR"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("⚠️  Ignoring invalid VOTE_CHECK_REPAIR %q", value)
+		}
+		repair = parsed
+	}
+
+	mismatches, err := checkVotes(store, repair)
+	if err != nil {
+		log.Printf("⚠️  Failed to check vote totals: %v", err)
+		return
+	}
+	if len(mismatches) > 0 && !repair {
+		log.Printf("⚠️  %d vote totals don't match user votes, set VOTE_CHECK_REPAIR=true or use the repair endpoint to fix them", len(mismatches))
+	}
+}
+
+// checkVotes returns the tracks whose totals don't match their user votes in
+// the given playlists (all without any). With repair, their totals are
+// recomputed and Expected holds the repaired total.
+func checkVotes(store Store, repair bool, playlistIDs ...string) ([]VoteMismatch, error) {
+	mismatches, err := store.VoteMismatches(playlistIDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range mismatches {
+		log.Printf("🔍 Track %s in playlist %s has %d votes stored, user votes add up to %d", m.TrackID, m.PlaylistID, m.Stored, m.Expected)
+		if !repair {
+			continue
+		}
+		total, err := store.RepairVotes(trackKey{m.PlaylistID, m.TrackID})
+		if err != nil {
+			return nil, err
+		}
+		mismatches[i].Expected = total
+	}
+
+	if repair && len(mismatches) > 0 {
+		log.Printf("🔧 Repaired %d vote totals", len(mismatches))
+	}
+	return mismatches, nil
+}
+
+// handleCheckVotes reports the playlist's vote totals that don't match its
+// user votes. POST repairs them and updates everyone's view.
+func (app *App) handleCheckVotes(w http.ResponseWriter, r *http.Request) {
+	playlistID := mux.Vars(r)["id"]
+	repair := r.Method == http.MethodPost
+
+	mismatches, err := checkVotes(app.store, repair, playlistID)
+	if err != nil {
+		log.Printf("Failed to check vote totals: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if repair {
+		for _, m := range mismatches {
+			app.publishTrackVotes(trackKey{m.PlaylistID, m.TrackID}, m.Expected)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mismatches": mismatches,
+		"repaired":   repair,
+	})
+}
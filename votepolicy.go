@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Voting policies limit and weigh votes per playlist, see PlaylistSettings:
+// a budget of upvotes per user per period, extra weight for hosts and
+// superlikes, upvotes that count several times.
+
+var (
+	errNoUpvotesLeft    = errors.New("no upvotes left for now, take one back or wait")
+	errNoSuperlikesLeft = errors.New("no superlikes left for now")
+)
+
+// StoredVote is a user's current vote on a track.
+type StoredVote struct {
+	Vote      int  // -1, 0 or 1
+	Weight    int  // how many points the vote is worth
+	Superlike bool // an upvote worth the playlist's superlike weight
+}
+
+// points is what the vote adds to the track's total.
+func (v StoredVote) points() int {
+	return v.Vote * v.Weight
+}
+
+// Ballot is a click on a vote button, with the playlist's policy applied.
+type Ballot struct {
+	Vote      int // 1 or -1
+	Superlike bool
+	Weight    int // host and superlike weight included
+
+	// Standing upvotes and superlikes the user may have in the playlist cast
+	// since BudgetSince. No upvote limit when UpvoteBudget is 0.
+	UpvoteBudget    int
+	SuperlikeBudget int
+	BudgetSince     time.Time
+}
+
+// VoteUsage counts a user's standing upvotes and superlikes in a playlist.
+type VoteUsage struct {
+	Upvotes    int
+	Superlikes int
+}
+
+// castBallot applies a ballot to the user's current vote, Reddit style:
+// clicking the same button again takes the vote back. used counts the user's
+// votes on the playlist's other tracks.
+func castBallot(current StoredVote, ballot Ballot, used VoteUsage) (StoredVote, error) {
+	if current.Vote == ballot.Vote && current.Superlike == ballot.Superlike {
+		return StoredVote{Weight: 1}, nil
+	}
+
+	next := StoredVote{Vote: ballot.Vote, Weight: ballot.Weight, Superlike: ballot.Superlike}
+	if next.Vote > 0 && ballot.UpvoteBudget > 0 && used.Upvotes >= ballot.UpvoteBudget {
+		return current, errNoUpvotesLeft
+	}
+	if next.Superlike && used.Superlikes >= ballot.SuperlikeBudget {
+		return current, errNoSuperlikesLeft
+	}
+	return next, nil
+}
+
+// VoteBudget is what a user has left to vote with in a playlist.
+type VoteBudget struct {
+	UpvotesLeft       *int `json:"upvotes_left"` // nil if unlimited
+	SuperlikesEnabled bool `json:"superlikes_enabled"`
+	SuperlikesLeft    int  `json:"superlikes_left"`
+	PeriodHours       int  `json:"period_hours"`
+}
+
+// ballot turns a click into a ballot under the playlist's policy. role is the
+// voter's role on the playlist.
+func (s PlaylistSettings) ballot(vote int, superlike bool, role string, now time.Time) Ballot {
+	weight := 1
+	if roleAtLeast(role, RoleModerator) {
+		weight = s.HostVoteWeight
+	}
+	if superlike {
+		weight *= s.SuperlikeWeight
+	}
+
+	return Ballot{
+		Vote:            vote,
+		Superlike:       superlike,
+		Weight:          weight,
+		UpvoteBudget:    s.UpvoteBudget,
+		SuperlikeBudget: s.SuperlikeBudget,
+		BudgetSince:     s.budgetSince(now),
+	}
+}
+
+// budgetSince is the start of the current budget period: votes cast before it
+// no longer count against the budget.
+func (s PlaylistSettings) budgetSince(now time.Time) time.Time {
+	return now.Add(-time.Duration(s.BudgetPeriodHours) * time.Hour)
+}
+
+func (s PlaylistSettings) budget(used VoteUsage) VoteBudget {
+	budget := VoteBudget{
+		SuperlikesEnabled: s.SuperlikeBudget > 0,
+		SuperlikesLeft:    max(0, s.SuperlikeBudget-used.Superlikes),
+		PeriodHours:       s.BudgetPeriodHours,
+	}
+	if s.UpvoteBudget > 0 {
+		left := max(0, s.UpvoteBudget-used.Upvotes)
+		budget.UpvotesLeft = &left
+	}
+	return budget
+}
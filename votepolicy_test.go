@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCastBallot(t *testing.T) {
+	upvote := StoredVote{Vote: 1, Weight: 1}
+	downvote := StoredVote{Vote: -1, Weight: 1}
+	superlike := StoredVote{Vote: 1, Weight: 3, Superlike: true}
+	none := StoredVote{Weight: 1}
+
+	tests := []struct {
+		name    string
+		current StoredVote
+		ballot  Ballot
+		used    VoteUsage
+		want    StoredVote
+		wantErr error
+	}{
+		{
+			name:    "upvote without a budget",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 1},
+			used:    VoteUsage{Upvotes: 100},
+			want:    upvote,
+		},
+		{
+			name:    "upvote below the budget",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 2},
+			want:    upvote,
+		},
+		{
+			name:    "upvote at the budget",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 3},
+			want:    none,
+			wantErr: errNoUpvotesLeft,
+		},
+		{
+			name:    "upvote over the budget keeps the downvote",
+			current: downvote,
+			ballot:  Ballot{Vote: 1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 4},
+			want:    downvote,
+			wantErr: errNoUpvotesLeft,
+		},
+		{
+			name:    "downvote at the budget",
+			current: none,
+			ballot:  Ballot{Vote: -1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 3},
+			want:    downvote,
+		},
+		{
+			name:    "switching an upvote to a downvote at the budget",
+			current: upvote,
+			ballot:  Ballot{Vote: -1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 3},
+			want:    downvote,
+		},
+		{
+			name:    "taking back an upvote at the budget",
+			current: upvote,
+			ballot:  Ballot{Vote: 1, Weight: 1, UpvoteBudget: 3},
+			used:    VoteUsage{Upvotes: 3},
+			want:    none,
+		},
+		{
+			name:    "host weight",
+			current: none,
+			ballot:  Ballot{Vote: -1, Weight: 2},
+			want:    StoredVote{Vote: -1, Weight: 2},
+		},
+		{
+			name:    "superlike below the budget",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true, SuperlikeBudget: 1},
+			want:    superlike,
+		},
+		{
+			name:    "superlike at the budget",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true, SuperlikeBudget: 1},
+			used:    VoteUsage{Upvotes: 1, Superlikes: 1},
+			want:    none,
+			wantErr: errNoSuperlikesLeft,
+		},
+		{
+			name:    "superlike without superlikes enabled",
+			current: upvote,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true},
+			want:    upvote,
+			wantErr: errNoSuperlikesLeft,
+		},
+		{
+			name:    "superlike needs an upvote left too",
+			current: none,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true, UpvoteBudget: 2, SuperlikeBudget: 1},
+			used:    VoteUsage{Upvotes: 2},
+			want:    none,
+			wantErr: errNoUpvotesLeft,
+		},
+		{
+			name:    "upgrading an upvote to a superlike",
+			current: upvote,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true, UpvoteBudget: 3, SuperlikeBudget: 1},
+			used:    VoteUsage{Upvotes: 2},
+			want:    superlike,
+		},
+		{
+			name:    "taking back a superlike at the budget",
+			current: superlike,
+			ballot:  Ballot{Vote: 1, Weight: 3, Superlike: true, SuperlikeBudget: 1},
+			used:    VoteUsage{Superlikes: 1},
+			want:    none,
+		},
+		{
+			name:    "downgrading a superlike to an upvote",
+			current: superlike,
+			ballot:  Ballot{Vote: 1, Weight: 1, SuperlikeBudget: 1},
+			used:    VoteUsage{Superlikes: 1},
+			want:    upvote,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := castBallot(tt.current, tt.ballot, tt.used)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("castBallot() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("castBallot() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaylistSettingsBudget(t *testing.T) {
+	tests := []struct {
+		name           string
+		settings       PlaylistSettings
+		used           VoteUsage
+		wantUpvotes    *int
+		wantSuperlikes int
+	}{
+		{
+			name:     "unlimited",
+			settings: PlaylistSettings{},
+			used:     VoteUsage{Upvotes: 10},
+		},
+		{
+			name:           "some left",
+			settings:       PlaylistSettings{UpvoteBudget: 5, SuperlikeBudget: 2},
+			used:           VoteUsage{Upvotes: 3, Superlikes: 1},
+			wantUpvotes:    intPtr(2),
+			wantSuperlikes: 1,
+		},
+		{
+			name:           "overspent after the budget was lowered",
+			settings:       PlaylistSettings{UpvoteBudget: 2, SuperlikeBudget: 1},
+			used:           VoteUsage{Upvotes: 4, Superlikes: 3},
+			wantUpvotes:    intPtr(0),
+			wantSuperlikes: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.settings.budget(tt.used)
+			if (got.UpvotesLeft == nil) != (tt.wantUpvotes == nil) ||
+				(got.UpvotesLeft != nil && *got.UpvotesLeft != *tt.wantUpvotes) {
+				t.Errorf("UpvotesLeft = %v, want %v", ptrString(got.UpvotesLeft), ptrString(tt.wantUpvotes))
+			}
+			if got.SuperlikesLeft != tt.wantSuperlikes {
+				t.Errorf("SuperlikesLeft = %d, want %d", got.SuperlikesLeft, tt.wantSuperlikes)
+			}
+		})
+	}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func ptrString(n *int) string {
+	if n == nil {
+		return "unlimited"
+	}
+	return fmt.Sprint(*n)
+}